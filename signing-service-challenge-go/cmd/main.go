@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
+	"expvar"
+	"fmt"
+
 	"github.com/sirupsen/logrus"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/api"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/configuration"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/keystore"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
 	deviceService "github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/device"
 	signService "github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/sign"
 )
@@ -25,20 +31,112 @@ func main() {
 
 func runServer(config *configuration.Configuration) error {
 	// repositories
-	storage := persistence.NewInMemoryStorage()
+	storage, err := createStorage(config)
+	if err != nil {
+		return err
+	}
+	keyStore, err := createKeyStore(config)
+	if err != nil {
+		return err
+	}
 
 	//services
-	factory := crypto.NewFactory()
-	deviceSrv := deviceService.NewDeviceService(storage, factory)
-	signSrv := signService.NewSignService(storage, factory)
+	idPolicy, err := deviceService.ParseIDPolicy(config.DeviceIDPolicy)
+	if err != nil {
+		return err
+	}
+	deviceSrv := deviceService.NewDeviceService(storage, keyStore, idPolicy, services.SystemClock)
+	signSrv := signService.NewSignService(storage, keyStore, services.SystemClock)
+	verifySrv := signService.NewVerifyService(storage, keyStore)
+
+	server := api.NewServer(config.ListenAddress, deviceSrv, signSrv, verifySrv)
 
-	server := api.NewServer(config.ListenAddress, deviceSrv, signSrv)
+	// the metrics are kept off the API listener, the API keeps serving when they can't be
+	go func() {
+		logrus.Info("serving metrics on " + config.MetricsListenAddress)
+		if err := api.RunMetrics(config.MetricsListenAddress); err != nil {
+			logrus.WithError(err).Error("metrics listener stopped")
+		}
+	}()
 
 	logrus.Info("starting server on port " + config.ListenAddress)
-	err := server.Run()
+	err = server.Run()
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// createStorage sets up the storage backend holding devices and signings.
+func createStorage(config *configuration.Configuration) (persistence.Storage, error) {
+	switch config.Storage {
+	case "memory":
+		if config.JournalDir == "" {
+			return persistence.NewInMemoryStorage(), nil
+		}
+		return persistence.NewJournaledStorage(persistence.JournalOptions{
+			Dir:          config.JournalDir,
+			Sync:         persistence.SyncPolicy(config.JournalSync),
+			SyncInterval: config.JournalSyncInterval,
+			CompactEvery: config.JournalCompactEvery,
+		})
+	case "postgres":
+		if config.DatabaseURL == "" {
+			return nil, errors.New("DATABASE_URL is required for the postgres storage")
+		}
+		return persistence.NewPostgresStorage(config.DatabaseURL)
+	case "sqlite":
+		return persistence.NewSQLiteStorage(config.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", config.Storage)
+	}
+}
+
+// createKeyStore sets up the key store holding the private keys. The file key store encrypts them at rest
+// when KEKs are configured and re-wraps the keys of retired KEKs on startup.
+func createKeyStore(config *configuration.Configuration) (keystore.KeyStore, error) {
+	factory := crypto.NewFactory()
+
+	var keyCache *keystore.SignerCache
+	if config.KeyStore == "file" && config.KeyCacheSize > 0 {
+		keyCache = keystore.NewSignerCache(config.KeyCacheSize)
+	}
+	// published with every key store, the counters stay at zero when the keys aren't cached
+	expvar.Publish("key_cache", expvar.Func(func() any {
+		return keyCache.Stats()
+	}))
+
+	switch config.KeyStore {
+	case "memory":
+		return keystore.NewSoftwareKeyStore(factory), nil
+	case "file":
+		var keyring *crypto.Keyring
+		if config.KeyEncryptionKeys == "" {
+			logrus.Warn("no key encryption keys configured, private keys are stored unencrypted")
+		} else {
+			keys, err := crypto.ParseKeyEncryptionKeys(config.KeyEncryptionKeys)
+			if err != nil {
+				return nil, err
+			}
+			if keyring, err = crypto.NewKeyring(keys); err != nil {
+				return nil, err
+			}
+		}
+
+		fileKeyStore, err := keystore.NewFileKeyStore(config.KeyStorePath, factory, keyring, keyCache)
+		if err != nil {
+			return nil, err
+		}
+		rewrapped, err := fileKeyStore.Rewrap()
+		if err != nil {
+			return nil, err
+		}
+		if keyring != nil {
+			logrus.Infof("private keys encrypted with %s, %d re-wrapped on startup", keyring.ActiveID(), rewrapped)
+		}
+		return fileKeyStore, nil
+	default:
+		return nil, fmt.Errorf("unknown key store %q", config.KeyStore)
+	}
+}
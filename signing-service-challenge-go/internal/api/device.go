@@ -2,28 +2,76 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+	deviceService "github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/device"
 )
 
 type DeviceDTO struct {
-	Id        string  `json:"id"`        // for simplicity, we are not going to check if this is uuid
-	Algorithm string  `json:"algorithm"` // the validation is done on the service level, so we delegate the check there
-	Label     *string `json:"label,omitempty"`
-	Counter   int     `json:"signature_counter"`
+	Id        string            `json:"id"`        // generated when it is empty, the service validates it against its id policy
+	Algorithm string            `json:"algorithm"` // the validation is done on the service level, so we delegate the check there
+	Curve     string            `json:"curve,omitempty"`
+	KeySize   int               `json:"key_size,omitempty"`
+	Padding   string            `json:"padding,omitempty"`
+	Label     *string           `json:"label,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Counter   int               `json:"signature_counter"` // counts the signings, a create or a patch sending it is answered with 422
+	// Version, CreatedAt, State, StateChangedAt, KeyID and KeyCreatedAt are set by the service, they are ignored when a device is created
+	Version        int64      `json:"version"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	State          string     `json:"state,omitempty"`
+	StateChangedAt *time.Time `json:"state_changed_at,omitempty"`
+	// KeyID and KeyCreatedAt describe the active key
+	KeyID        string     `json:"key_id,omitempty"`
+	KeyCreatedAt *time.Time `json:"key_created_at,omitempty"`
+}
+
+type DeviceStateDTO struct {
+	State string `json:"state"`
+}
+
+const contentTypeMergePatch = "application/merge-patch+json"
+
+// immutableDeviceFields are the fields of DeviceDTO a patch can't change, only label and metadata are editable.
+var immutableDeviceFields = map[string]bool{
+	"id":                true,
+	"algorithm":         true,
+	"curve":             true,
+	"key_size":          true,
+	"padding":           true,
+	"signature_counter": true,
+	"version":           true,
+	"created_at":        true,
+	"state":             true,
+	"state_changed_at":  true,
+	"key_id":            true,
+	"key_created_at":    true,
 }
 
 func (s *Server) CreateDevice(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodPost {
-		WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
+	var body json.RawMessage
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || json.Unmarshal(body, &fields) != nil || fields == nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid request payload, a JSON object is expected")
+		return
+	}
+	// the counter is only changed by signing, like a patch a create can't set it
+	if _, set := fields["signature_counter"]; set {
+		err := services.NewValidationError(services.CodeImmutableField, "signature_counter can't be set, it counts the signings of the device")
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, err, err.Error())
 		return
 	}
-
 	var device DeviceDTO
-	if err := json.NewDecoder(request.Body).Decode(&device); err != nil {
+	if err := json.Unmarshal(body, &device); err != nil {
 		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid request payload")
 		return
 	}
@@ -34,58 +82,149 @@ func (s *Server) CreateDevice(response http.ResponseWriter, request *http.Reques
 		return
 	}
 
-	result, err := s.deviceService.GetById(device.Id)
+	result, err := s.deviceService.GetById(input.ID)
 	if err != nil {
 		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
 		return
 	}
 
 	output := convertDeviceDomainModelToDTO(result)
+	setDeviceETag(response, result)
 	WriteAPIResponse(response, http.StatusCreated, output)
 }
 
 func (s *Server) GetDeviceById(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
+	result, err := s.deviceService.GetById(PathParam(request, "id"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
 		return
 	}
 
-	path := strings.TrimPrefix(request.URL.Path, "/api/v0/device/")
-	// Validate and extract the ID
-	if path == "" || strings.Contains(path, "/") {
-		http.Error(response, "Invalid or missing ID", http.StatusBadRequest)
+	output := convertDeviceDomainModelToDTO(result)
+	setDeviceETag(response, result)
+	WriteAPIResponse(response, http.StatusOK, output)
+}
+
+// UpdateDevice applies a JSON merge patch (RFC 7396) to the label and the metadata of a device. Any other field is
+// answered with 422. With If-Match the patch only applies while the device still has that ETag, otherwise it fails
+// with 412.
+func (s *Server) UpdateDevice(response http.ResponseWriter, request *http.Request) {
+	deviceId := PathParam(request, "id")
+
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || (mediaType != contentTypeMergePatch && mediaType != "application/json") {
+		WriteErrorResponse(response, http.StatusUnsupportedMediaType, nil, "Patches have to be sent as "+contentTypeMergePatch)
+		return
+	}
+
+	var version *int64
+	if ifMatch := strings.TrimSpace(request.Header.Get("If-Match")); ifMatch != "" && ifMatch != "*" {
+		parsed, err := strconv.ParseInt(strings.Trim(ifMatch, `"`), 10, 64)
+		if err != nil || !strings.HasPrefix(ifMatch, `"`) || !strings.HasSuffix(ifMatch, `"`) {
+			WriteErrorResponse(response, http.StatusPreconditionFailed, nil, "If-Match has to be the ETag of the device")
+			return
+		}
+		version = &parsed
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(request.Body).Decode(&fields); err != nil || fields == nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid request payload, a JSON object is expected")
+		return
+	}
+	patch, err := convertDevicePatchToDomainModel(fields)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, err, err.Error())
 		return
 	}
 
-	result, err := s.deviceService.GetById(path)
+	result, err := s.deviceService.UpdateDetails(deviceId, version, patch)
 	if err != nil {
 		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
 		return
 	}
 
 	output := convertDeviceDomainModelToDTO(result)
+	setDeviceETag(response, result)
 	WriteAPIResponse(response, http.StatusOK, output)
 }
 
-func (s *Server) GetAllDevices(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
+// setDeviceETag versions the editable fields of the device, signing doesn't change it.
+func setDeviceETag(response http.ResponseWriter, device *domain.Device) {
+	if device != nil {
+		response.Header().Set("ETag", strconv.Quote(strconv.FormatInt(device.Version, 10)))
+	}
+}
+
+// convertDevicePatchToDomainModel reads the members of a merge patch, a null member removes the field.
+func convertDevicePatchToDomainModel(fields map[string]json.RawMessage) (deviceService.DevicePatch, error) {
+	var patch deviceService.DevicePatch
+	for name, value := range fields {
+		switch {
+		case name == "label":
+			patch.SetLabel = true
+			if err := json.Unmarshal(value, &patch.Label); err != nil {
+				return patch, services.NewValidationError(services.CodeInvalidRequest, "label has to be a string or null")
+			}
+		case name == "metadata":
+			if err := json.Unmarshal(value, &patch.Metadata); err != nil {
+				return patch, services.NewValidationError(services.CodeInvalidMetadata, "metadata has to be an object of strings or null")
+			}
+			patch.ClearMetadata = patch.Metadata == nil
+		case immutableDeviceFields[name]:
+			return patch, services.NewValidationError(services.CodeImmutableField, name+" can't be changed, only label and metadata are editable")
+		default:
+			return patch, services.NewValidationError(services.CodeImmutableField, "unknown field "+name+", only label and metadata are editable")
+		}
+	}
+	return patch, nil
+}
+
+// UpdateDeviceState moves a device through its lifecycle: active, suspended and finally decommissioned.
+func (s *Server) UpdateDeviceState(response http.ResponseWriter, request *http.Request) {
+	deviceId := PathParam(request, "id")
+
+	var input DeviceStateDTO
+	if err := json.NewDecoder(request.Body).Decode(&input); err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid request payload")
 		return
 	}
 
-	pageNr, err := strconv.Atoi(request.URL.Query().Get("pageNr"))
-	if err != nil || pageNr < 1 {
-		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid or missing pageNr")
+	result, err := s.deviceService.UpdateState(deviceId, domain.DeviceState(strings.ToUpper(input.State)))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
 		return
 	}
 
+	output := convertDeviceDomainModelToDTO(result)
+	WriteAPIResponse(response, http.StatusOK, output)
+}
+
+// GetAllDevices pages through the devices passing the filter of the query by pageNr, or by cursor when pageNr is left
+// out.
+func (s *Server) GetAllDevices(response http.ResponseWriter, request *http.Request) {
 	pageSize, err := strconv.Atoi(request.URL.Query().Get("pageSize"))
 	if err != nil || pageSize < 1 {
 		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid or missing pageSize")
 		return
 	}
+	filter, err := parseDeviceFilter(request.URL.Query())
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid filter: "+err.Error())
+		return
+	}
+	if !request.URL.Query().Has("pageNr") {
+		s.getDevicesPage(response, request, filter, pageSize)
+		return
+	}
+
+	pageNr, err := strconv.Atoi(request.URL.Query().Get("pageNr"))
+	if err != nil || pageNr < 1 {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid or missing pageNr")
+		return
+	}
 
-	devices, totalCount, err := s.deviceService.GetAll(pageNr, pageSize)
+	devices, totalCount, err := s.deviceService.GetAll(filter, pageNr, pageSize)
 	if err != nil {
 		WriteErrorResponse(response, http.StatusInternalServerError, err, "Failed to retrieve devices")
 		return
@@ -95,6 +234,69 @@ func (s *Server) GetAllDevices(response http.ResponseWriter, request *http.Reque
 	WriteAPIResponse(response, http.StatusOK, output)
 }
 
+func (s *Server) getDevicesPage(response http.ResponseWriter, request *http.Request, filter domain.DeviceFilter, pageSize int) {
+	cursor, err := decodeCursor(request.URL.Query().Get("cursor"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid cursor")
+		return
+	}
+
+	page, err := s.deviceService.GetPage(filter, cursor, pageSize)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, "Failed to retrieve devices")
+		return
+	}
+
+	output := &PaginatedResponse[DeviceDTO]{
+		PageSize: pageSize,
+		Next:     encodeCursor(page.Next),
+		Prev:     encodeCursor(page.Prev),
+		Items:    []DeviceDTO{},
+	}
+	for _, device := range page.Items {
+		output.Items = append(output.Items, *convertDeviceDomainModelToDTO(device))
+	}
+	WriteAPIResponse(response, http.StatusOK, output)
+}
+
+// parseDeviceFilter reads the filter of a device listing from the query: algorithm, state, label (a substring),
+// createdFrom and createdTo (RFC 3339), minSignatureCounter, maxSignatureCounter, sort and order (asc or desc).
+// Values the service doesn't know, like an unknown algorithm, are left for it to reject.
+func parseDeviceFilter(query url.Values) (domain.DeviceFilter, error) {
+	filter := domain.DeviceFilter{
+		Algorithm: domain.AlgorithmType(query.Get("algorithm")),
+		State:     domain.DeviceState(query.Get("state")),
+		Label:     query.Get("label"),
+		Sort:      domain.DeviceSort(query.Get("sort")),
+	}
+	for name, bound := range map[string]*time.Time{"createdFrom": &filter.CreatedFrom, "createdTo": &filter.CreatedTo} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s is not an RFC 3339 time", name)
+			}
+			*bound = parsed
+		}
+	}
+	for name, bound := range map[string]**int64{"minSignatureCounter": &filter.MinCounter, "maxSignatureCounter": &filter.MaxCounter} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("%s is not an integer", name)
+			}
+			*bound = &parsed
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, errors.New("order is neither asc nor desc")
+	}
+	return filter, nil
+}
+
 func convertDeviceDTOtoDomainModel(input *DeviceDTO) *domain.Device {
 	if input == nil {
 		return nil
@@ -102,8 +304,13 @@ func convertDeviceDTOtoDomainModel(input *DeviceDTO) *domain.Device {
 	return &domain.Device{
 		ID:            input.Id,
 		Label:         input.Label,
-		Counter:       int64(input.Counter),
+		Metadata:      input.Metadata,
 		AlgorithmType: domain.ConvertStringToAlgorithmType(input.Algorithm),
+		Options: domain.AlgorithmOptions{
+			Curve:   domain.CurveType(input.Curve), // unsupported values are rejected by the service
+			KeySize: input.KeySize,
+			Padding: domain.PaddingType(input.Padding),
+		},
 	}
 }
 
@@ -111,19 +318,39 @@ func convertDeviceDomainModelToDTO(input *domain.Device) *DeviceDTO {
 	if input == nil {
 		return nil
 	}
-	return &DeviceDTO{
+	output := &DeviceDTO{
 		Id:        input.ID,
 		Label:     input.Label,
+		Metadata:  input.Metadata,
+		Version:   input.Version,
 		Counter:   int(input.Counter),
 		Algorithm: string(input.AlgorithmType),
+		Curve:     string(input.Options.Curve),
+		KeySize:   input.Options.KeySize,
+		Padding:   string(input.Options.Padding),
+		State:     string(input.State),
+		KeyID:     input.KeyID,
+	}
+	if !input.CreatedAt.IsZero() {
+		createdAt := input.CreatedAt
+		output.CreatedAt = &createdAt
+	}
+	if !input.StateChangedAt.IsZero() {
+		stateChangedAt := input.StateChangedAt
+		output.StateChangedAt = &stateChangedAt
+	}
+	if !input.KeyCreatedAt.IsZero() {
+		keyCreatedAt := input.KeyCreatedAt
+		output.KeyCreatedAt = &keyCreatedAt
 	}
+	return output
 }
 
 func convertDeviceListDomainModelToDTO(input *[]*domain.Device, page, pageSize, total int) *PaginatedResponse[DeviceDTO] {
 	if input == nil {
 		return nil
 	}
-	var results []DeviceDTO
+	results := []DeviceDTO{}
 	for _, device := range *input {
 		if device != nil {
 			results = append(results, *convertDeviceDomainModelToDTO(device))
@@ -131,7 +358,7 @@ func convertDeviceListDomainModelToDTO(input *[]*domain.Device, page, pageSize,
 	}
 	return &PaginatedResponse[DeviceDTO]{
 		Items:      results,
-		Total:      total,
+		Total:      &total,
 		PageNumber: page,
 		PageSize:   pageSize,
 	}
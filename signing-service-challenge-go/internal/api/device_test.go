@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/keystore"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+	deviceService "github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/device"
+)
+
+func newDeviceTestServer() (*Server, deviceService.DeviceService) {
+	devices := deviceService.NewDeviceService(persistence.NewInMemoryStorage(), keystore.NewSoftwareKeyStore(crypto.NewFactory()), deviceService.IDPolicySafe, services.SystemClock)
+	return NewServer("", devices, nil, nil), devices
+}
+
+func TestCreateDevice(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "Device created",
+			body:           `{"id":"till-1","algorithm":"ED25519","label":"till"}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Counter sent by the client",
+			body:           `{"id":"till-1","algorithm":"ED25519","signature_counter":5}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   services.CodeImmutableField,
+		},
+		{
+			name:           "Zero counter sent by the client",
+			body:           `{"id":"till-1","algorithm":"ED25519","signature_counter":0}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   services.CodeImmutableField,
+		},
+		{
+			name:           "Not an object",
+			body:           `["till-1"]`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			server, _ := newDeviceTestServer()
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/devices", strings.NewReader(test.body))
+			request.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+
+			// execute
+			server.Routes().ServeHTTP(recorder, request)
+
+			// asserts
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedCode != "" {
+				assert.Equal(t, test.expectedCode, decodeProblem(t, recorder).Code)
+				return
+			}
+			var created Response[DeviceDTO]
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+			assert.Equal(t, "till-1", created.Data.Id)
+			assert.Zero(t, created.Data.Counter)
+			assert.Equal(t, `"1"`, recorder.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestUpdateDevice(t *testing.T) {
+	tests := []struct {
+		name             string
+		contentType      string
+		ifMatch          string
+		body             string
+		expectedStatus   int
+		expectedCode     string
+		expectedLabel    *string
+		expectedMetadata map[string]string
+		expectedETag     string
+	}{
+		{
+			name:             "Merge patch",
+			contentType:      "application/merge-patch+json",
+			ifMatch:          `"1"`,
+			body:             `{"label":"till 2","metadata":{"store":"42","lane":null}}`,
+			expectedStatus:   http.StatusOK,
+			expectedLabel:    stringPointer("till 2"),
+			expectedMetadata: map[string]string{"store": "42"},
+			expectedETag:     `"2"`,
+		},
+		{
+			name:             "Null removes the label",
+			contentType:      "application/merge-patch+json; charset=utf-8",
+			body:             `{"label":null}`,
+			expectedStatus:   http.StatusOK,
+			expectedMetadata: map[string]string{"lane": "3"},
+			expectedETag:     `"2"`,
+		},
+		{
+			name:             "Without If-Match",
+			contentType:      "application/json",
+			body:             `{"metadata":{"lane":"4"}}`,
+			expectedStatus:   http.StatusOK,
+			expectedLabel:    stringPointer("till"),
+			expectedMetadata: map[string]string{"lane": "4"},
+			expectedETag:     `"2"`,
+		},
+		{
+			name:           "Immutable field",
+			contentType:    "application/merge-patch+json",
+			body:           `{"label":"till 2","signature_counter":7}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   services.CodeImmutableField,
+		},
+		{
+			name:           "Unknown field",
+			contentType:    "application/merge-patch+json",
+			body:           `{"colour":"red"}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   services.CodeImmutableField,
+		},
+		{
+			name:           "Metadata not an object of strings",
+			contentType:    "application/merge-patch+json",
+			body:           `{"metadata":{"lane":3}}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   services.CodeInvalidMetadata,
+		},
+		{
+			name:           "If-Match of another version",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        `"7"`,
+			body:           `{"label":"till 2"}`,
+			expectedStatus: http.StatusPreconditionFailed,
+			expectedCode:   services.CodeDeviceModified,
+		},
+		{
+			name:           "If-Match not an ETag",
+			contentType:    "application/merge-patch+json",
+			ifMatch:        "1",
+			body:           `{"label":"till 2"}`,
+			expectedStatus: http.StatusPreconditionFailed,
+			expectedCode:   "precondition_failed",
+		},
+		{
+			name:           "Wrong content type",
+			contentType:    "text/plain",
+			body:           `{"label":"till 2"}`,
+			expectedStatus: http.StatusUnsupportedMediaType,
+			expectedCode:   "unsupported_media_type",
+		},
+		{
+			name:           "Not an object",
+			contentType:    "application/merge-patch+json",
+			body:           `"till 2"`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   "bad_request",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			server, devices := newDeviceTestServer()
+			require.NoError(t, devices.Save(&domain.Device{
+				ID:            "till-1",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+				Label:         stringPointer("till"),
+				Metadata:      map[string]string{"lane": "3"},
+			}))
+			request := httptest.NewRequest(http.MethodPatch, "/api/v1/devices/till-1", strings.NewReader(test.body))
+			request.Header.Set("Content-Type", test.contentType)
+			if test.ifMatch != "" {
+				request.Header.Set("If-Match", test.ifMatch)
+			}
+			recorder := httptest.NewRecorder()
+
+			// execute
+			server.Routes().ServeHTTP(recorder, request)
+
+			// asserts
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			stored, err := devices.GetById("till-1")
+			require.NoError(t, err)
+			if test.expectedCode != "" {
+				assert.Equal(t, test.expectedCode, decodeProblem(t, recorder).Code)
+				assert.Equal(t, int64(1), stored.Version, "a rejected patch must not change the device")
+				return
+			}
+			var updated Response[DeviceDTO]
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &updated))
+			assert.Equal(t, test.expectedLabel, updated.Data.Label)
+			assert.Equal(t, test.expectedMetadata, updated.Data.Metadata)
+			assert.Equal(t, test.expectedETag, recorder.Header().Get("ETag"))
+			assert.Equal(t, test.expectedLabel, stored.Label)
+		})
+	}
+}
+
+func decodeProblem(t *testing.T, recorder *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	assert.Equal(t, contentTypeProblem, recorder.Header().Get("Content-Type"))
+	var problem Problem
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	return problem
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
@@ -9,11 +9,6 @@ type HealthResponse struct {
 
 // Health evaluates the health of the service and writes a standardized response.
 func (s *Server) Health(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
-		return
-	}
-
 	health := HealthResponse{
 		Status:  "pass",
 		Version: "v0",
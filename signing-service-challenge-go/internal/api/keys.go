@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+type DeviceKeyDTO struct {
+	Id        string     `json:"id"`
+	Version   int        `json:"version"`
+	Algorithm string     `json:"algorithm"`
+	Curve     string     `json:"curve,omitempty"`
+	KeySize   int        `json:"key_size,omitempty"`
+	Padding   string     `json:"padding,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// Active is set on the key new signatures are made with, the others only verify
+	Active bool `json:"active"`
+}
+
+// GetDeviceKeys lists the keys of a device, oldest first.
+func (s *Server) GetDeviceKeys(response http.ResponseWriter, request *http.Request) {
+	keys, err := s.deviceService.GetKeys(PathParam(request, "id"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, convertDeviceKeysDomainModelToDTO(keys))
+}
+
+// RotateDeviceKey generates a new key pair for the device that becomes the active one, the older keys are kept to
+// verify the signatures they made.
+func (s *Server) RotateDeviceKey(response http.ResponseWriter, request *http.Request) {
+	key, err := s.deviceService.RotateKey(PathParam(request, "id"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	output := convertDeviceKeyDomainModelToDTO(key)
+	output.Active = true
+	WriteAPIResponse(response, http.StatusCreated, output)
+}
+
+func convertDeviceKeyDomainModelToDTO(input *domain.DeviceSigner) DeviceKeyDTO {
+	output := DeviceKeyDTO{
+		Id:        input.ID,
+		Version:   input.Version,
+		Algorithm: string(input.AlgorithmType),
+		Curve:     string(input.Options.Curve),
+		KeySize:   input.Options.KeySize,
+		Padding:   string(input.Options.Padding),
+	}
+	if !input.CreatedAt.IsZero() {
+		createdAt := input.CreatedAt
+		output.CreatedAt = &createdAt
+	}
+	return output
+}
+
+// convertDeviceKeysDomainModelToDTO expects the keys oldest first, like the service returns them.
+func convertDeviceKeysDomainModelToDTO(input []*domain.DeviceSigner) []DeviceKeyDTO {
+	results := []DeviceKeyDTO{}
+	for i, key := range input {
+		output := convertDeviceKeyDomainModelToDTO(key)
+		output.Active = i == len(input)-1
+		results = append(results, output)
+	}
+	return results
+}
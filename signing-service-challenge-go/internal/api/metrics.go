@@ -0,0 +1,19 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// MetricsRoutes serves the expvar metrics: the key_cache counters next to the command line and the memory stats of
+// the process. Those are no business of API clients, so the metrics get a listener of their own.
+func MetricsRoutes() http.Handler {
+	router := NewRouter()
+	router.Handle(http.MethodGet, "/debug/vars", expvar.Handler())
+	return router
+}
+
+// RunMetrics serves MetricsRoutes on listenAddress.
+func RunMetrics(listenAddress string) error {
+	return http.ListenAndServe(listenAddress, MetricsRoutes())
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+// cursorToken is what the opaque cursors of the listings carry, clients only pass them back.
+type cursorToken struct {
+	CreatedAt *time.Time `json:"t,omitempty"`
+	ID        string     `json:"i,omitempty"`
+	Counter   int64      `json:"c,omitempty"`
+	Backward  bool       `json:"b,omitempty"`
+}
+
+// encodeCursor returns the token of the cursor, empty for a nil cursor.
+func encodeCursor(cursor *domain.PageCursor) string {
+	if cursor == nil {
+		return ""
+	}
+	token := cursorToken{ID: cursor.ID, Counter: cursor.Counter, Backward: cursor.Backward}
+	if !cursor.CreatedAt.IsZero() {
+		createdAt := cursor.CreatedAt
+		token.CreatedAt = &createdAt
+	}
+	encoded, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor reads a token of encodeCursor, an empty token is the start of the listing.
+func decodeCursor(token string) (*domain.PageCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var cursor cursorToken
+	if err = json.Unmarshal(decoded, &cursor); err != nil {
+		return nil, err
+	}
+	result := &domain.PageCursor{ID: cursor.ID, Counter: cursor.Counter, Backward: cursor.Backward}
+	if cursor.CreatedAt != nil {
+		result.CreatedAt = *cursor.CreatedAt
+	}
+	return result, nil
+}
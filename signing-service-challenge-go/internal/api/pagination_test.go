@@ -0,0 +1,44 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+func TestCursorToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor *domain.PageCursor
+	}{
+		{
+			name:   "Device cursor",
+			cursor: &domain.PageCursor{CreatedAt: time.Date(2024, 3, 1, 12, 30, 0, 123000000, time.UTC), ID: "till/1"},
+		},
+		{
+			name:   "Backward signing cursor",
+			cursor: &domain.PageCursor{Counter: 42, Backward: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// execute
+			token := encodeCursor(test.cursor)
+			decoded, err := decodeCursor(token)
+
+			// asserts
+			assert.NoError(t, err)
+			assert.Equal(t, test.cursor, decoded)
+			assert.NotContains(t, token, "/", "tokens are used in query strings")
+		})
+	}
+
+	cursor, err := decodeCursor("")
+	assert.NoError(t, err)
+	assert.Nil(t, cursor, "an empty token starts at the beginning")
+	_, err = decodeCursor("not a token")
+	assert.Error(t, err)
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	contentTypePEM = "application/x-pem-file"
+	contentTypeDER = "application/octet-stream"
+	contentTypeJWK = "application/jwk+json"
+)
+
+// publicKeyFormats maps the values of the format query parameter to the content type we answer with.
+var publicKeyFormats = map[string]string{
+	"pem": contentTypePEM,
+	"der": contentTypeDER,
+	"jwk": contentTypeJWK,
+}
+
+// publicKeyMediaTypes maps the media types accepted by the client to the content type we answer with.
+var publicKeyMediaTypes = map[string]string{
+	contentTypePEM:         contentTypePEM,
+	"application/x-pem":    contentTypePEM,
+	"text/plain":           contentTypePEM,
+	"*/*":                  contentTypePEM,
+	contentTypeDER:         contentTypeDER,
+	"application/pkix-key": contentTypeDER,
+	contentTypeJWK:         contentTypeJWK,
+	"application/json":     contentTypeJWK,
+}
+
+// GetDevicePublicKey exports the public key of a device as PEM, DER or JWK.
+// The format is taken from the format query parameter or, when missing, from the Accept header (PEM by default).
+// It is the active key unless the key_id query parameter names an older one. The JWK kid is the key id rather than the
+// device id, which would name every key of a rotated device alike.
+func (s *Server) GetDevicePublicKey(response http.ResponseWriter, request *http.Request) {
+	deviceId := PathParam(request, "id")
+
+	contentType, ok := negotiatePublicKeyFormat(request)
+	if !ok {
+		WriteErrorResponse(response, http.StatusNotAcceptable, nil, "Supported formats are PEM, DER and JWK")
+		return
+	}
+
+	publicKey, keyID, err := s.deviceService.GetPublicKey(deviceId, request.URL.Query().Get("key_id"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	var body []byte
+	switch contentType {
+	case contentTypePEM:
+		body, err = crypto.MarshalPublicKeyPEM(publicKey)
+	case contentTypeDER:
+		body, err = crypto.MarshalPublicKeyDER(publicKey)
+	case contentTypeJWK:
+		var jwk *crypto.JWK
+		jwk, err = crypto.MarshalPublicKeyJWK(publicKey, keyID)
+		if err == nil {
+			body, err = json.Marshal(jwk)
+		}
+	}
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	response.Header().Set("Content-Type", contentType)
+	response.WriteHeader(http.StatusOK)
+	if _, err = response.Write(body); err != nil {
+		logrus.WithError(err).Error("failed to write public key response")
+	}
+}
+
+// negotiatePublicKeyFormat picks the first supported media type of the Accept header, quality values are not weighted.
+func negotiatePublicKeyFormat(request *http.Request) (string, bool) {
+	if format := request.URL.Query().Get("format"); format != "" {
+		contentType, ok := publicKeyFormats[strings.ToLower(format)]
+		return contentType, ok
+	}
+
+	accept := request.Header.Get("Accept")
+	if accept == "" {
+		return contentTypePEM, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if contentType, ok := publicKeyMediaTypes[mediaType]; ok {
+			return contentType, true
+		}
+	}
+	return "", false
+}
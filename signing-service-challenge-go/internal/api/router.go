@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Router dispatches requests on their method and path. Patterns are made of literal segments and {name} segments,
+// which match any one non-empty segment and are read with PathParam. A path only registered for other methods is
+// answered with 405 and an Allow header listing them, a path matching no pattern with 404.
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+type pathParamsKey struct{}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers the handler for method and pattern, e.g. Handle(http.MethodGet, "/api/v1/devices/{id}", ...).
+func (r *Router) Handle(method string, pattern string, handler http.Handler) {
+	r.routes = append(r.routes, route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  handler,
+	})
+}
+
+// HandleFunc registers the handler function for method and pattern.
+func (r *Router) HandleFunc(method string, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	r.Handle(method, pattern, http.HandlerFunc(handler))
+}
+
+func (r *Router) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	segments, err := unescapeSegments(splitPath(request.URL.EscapedPath()))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid path")
+		return
+	}
+
+	var allowed []string
+	for _, route := range r.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != request.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		if len(params) > 0 {
+			request = request.WithContext(context.WithValue(request.Context(), pathParamsKey{}, params))
+		}
+		route.handler.ServeHTTP(response, request)
+		return
+	}
+
+	if len(allowed) == 0 {
+		WriteErrorResponse(response, http.StatusNotFound, nil, http.StatusText(http.StatusNotFound))
+		return
+	}
+	sort.Strings(allowed)
+	response.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
+}
+
+// match returns the values of the {name} segments when the path segments match the route.
+func (r route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// PathParam returns the value of the {name} segment of the route that matched the request.
+func PathParam(request *http.Request, name string) string {
+	params, _ := request.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// splitPath splits a path into its segments, a trailing slash is ignored.
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// unescapeSegments decodes the segments of an escaped path, so an encoded slash stays inside its segment.
+func unescapeSegments(segments []string) ([]string, error) {
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
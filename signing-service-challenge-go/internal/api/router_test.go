@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	echo := func(name string) http.HandlerFunc {
+		return func(response http.ResponseWriter, request *http.Request) {
+			_, _ = response.Write([]byte(name + ":" + PathParam(request, "id") + ":" + PathParam(request, "counter")))
+		}
+	}
+	router.HandleFunc(http.MethodGet, "/api/v1/devices", echo("list"))
+	router.HandleFunc(http.MethodPost, "/api/v1/devices", echo("create"))
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}", echo("get"))
+	router.HandleFunc(http.MethodPatch, "/api/v1/devices/{id}", echo("update"))
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}/signatures/{counter}", echo("signature"))
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectedAllow  string
+	}{
+		{
+			name:           "Literal path",
+			method:         http.MethodPost,
+			path:           "/api/v1/devices",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "create::",
+		},
+		{
+			name:           "Trailing slash",
+			method:         http.MethodGet,
+			path:           "/api/v1/devices/",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "list::",
+		},
+		{
+			name:           "Path parameters",
+			method:         http.MethodGet,
+			path:           "/api/v1/devices/till-1/signatures/42",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "signature:till-1:42",
+		},
+		{
+			name:           "Encoded slash stays in its segment",
+			method:         http.MethodPatch,
+			path:           "/api/v1/devices/till%2F1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "update:till/1:",
+		},
+		{
+			name:           "Wrong method",
+			method:         http.MethodDelete,
+			path:           "/api/v1/devices/till-1",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedAllow:  "GET, PATCH",
+		},
+		{
+			name:           "Unknown path",
+			method:         http.MethodGet,
+			path:           "/api/v1/devices/till-1/unknown",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Empty parameter",
+			method:         http.MethodGet,
+			path:           "/api/v1/devices//signatures/1",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest(test.method, test.path, nil)
+
+			// execute
+			router.ServeHTTP(response, request)
+
+			// asserts
+			assert.Equal(t, test.expectedStatus, response.Code)
+			if test.expectedBody != "" {
+				assert.Equal(t, test.expectedBody, response.Body.String())
+			}
+			assert.Equal(t, test.expectedAllow, response.Header().Get("Allow"))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 
@@ -13,15 +14,18 @@ import (
 )
 
 type Response[T any] struct {
-	Data T      `json:"data"`
-	Err  string `json:"error_message"`
+	Data T `json:"data"`
 }
 
+// PaginatedResponse is a page of a listing. Pages requested by pageNr have their number and the total, pages requested
+// by cursor the tokens of the pages next to them instead, left out at the ends of the listing.
 type PaginatedResponse[T any] struct {
-	PageNumber int `json:"page_number"`
-	PageSize   int `json:"page_size"`
-	Total      int `json:"total"`
-	Items      []T `json:"items"`
+	PageNumber int    `json:"page_number,omitempty"`
+	PageSize   int    `json:"page_size"`
+	Total      *int   `json:"total,omitempty"`
+	Next       string `json:"next,omitempty"`
+	Prev       string `json:"prev,omitempty"`
+	Items      []T    `json:"items"`
 }
 
 // Server manages HTTP requests and dispatches them to the appropriate services.
@@ -29,62 +33,127 @@ type Server struct {
 	listenAddress    string
 	deviceService    deviceService.DeviceService
 	signatureService signService.SignService
+	verifyService    signService.VerifyService
 }
 
 // NewServer is a factory to instantiate a new Server.
-func NewServer(listenAddress string, deviceService deviceService.DeviceService, signatureService signService.SignService) *Server {
+func NewServer(listenAddress string, deviceService deviceService.DeviceService, signatureService signService.SignService, verifyService signService.VerifyService) *Server {
 	return &Server{
 		listenAddress:    listenAddress,
 		deviceService:    deviceService,
 		signatureService: signatureService,
+		verifyService:    verifyService,
 	}
 }
 
-// Run registers all HandlerFuncs for the existing HTTP routes and starts the Server.
+// Run starts the Server with the routes of Routes.
 func (s *Server) Run() error {
-	mux := http.NewServeMux()
+	return http.ListenAndServe(s.listenAddress, s.Routes())
+}
+
+// Routes maps the resource paths of the API to the handlers. The v0 paths are kept as aliases of the v1 ones.
+func (s *Server) Routes() http.Handler {
+	router := NewRouter()
 
-	mux.Handle("/api/v0/health", http.HandlerFunc(s.Health))
+	router.HandleFunc(http.MethodGet, "/api/v1/health", s.Health)
 
 	// signature-devices
-	mux.Handle("/api/v0/device", http.HandlerFunc(s.CreateDevice))
-	mux.Handle("/api/v0/device/", http.HandlerFunc(s.GetDeviceById))
-	mux.Handle("/api/v0/devices", http.HandlerFunc(s.GetAllDevices))
+	router.HandleFunc(http.MethodGet, "/api/v1/devices", s.GetAllDevices)
+	router.HandleFunc(http.MethodPost, "/api/v1/devices", s.CreateDevice)
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}", s.GetDeviceById)
+	router.HandleFunc(http.MethodPatch, "/api/v1/devices/{id}", s.UpdateDevice)
+	router.HandleFunc(http.MethodPatch, "/api/v1/devices/{id}/state", s.UpdateDeviceState)
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}/public-key", s.GetDevicePublicKey)
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}/keys", s.GetDeviceKeys)
+	router.HandleFunc(http.MethodPost, "/api/v1/devices/{id}/keys", s.RotateDeviceKey)
 
 	// signing-creation
-	mux.Handle("/api/v0/sign", http.HandlerFunc(s.CreateSigning))
-	mux.Handle("/api/v0/signings", http.HandlerFunc(s.GetAllSignings))
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}/signatures", s.GetAllSignings)
+	router.HandleFunc(http.MethodPost, "/api/v1/devices/{id}/signatures", s.CreateSigning)
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}/signatures/{counter}", s.GetSigning)
+	router.HandleFunc(http.MethodGet, "/api/v1/signatures/{signatureId}", s.GetSigningByID)
+
+	// signature-verification
+	router.HandleFunc(http.MethodPost, "/api/v1/verify", s.VerifySignature)
+	router.HandleFunc(http.MethodGet, "/api/v1/devices/{id}/chain/verify", s.VerifyDeviceChain)
+
+	// v0 aliases
+	router.HandleFunc(http.MethodGet, "/api/v0/health", s.Health)
+	router.HandleFunc(http.MethodPost, "/api/v0/device", s.CreateDevice)
+	router.HandleFunc(http.MethodGet, "/api/v0/devices", s.GetAllDevices)
+	router.HandleFunc(http.MethodGet, "/api/v0/device/{id}", s.GetDeviceById)
+	router.HandleFunc(http.MethodPatch, "/api/v0/device/{id}", s.UpdateDevice)
+	router.HandleFunc(http.MethodPatch, "/api/v0/device/{id}/state", s.UpdateDeviceState)
+	router.HandleFunc(http.MethodGet, "/api/v0/device/{id}/public-key", s.GetDevicePublicKey)
+	router.HandleFunc(http.MethodGet, "/api/v0/device/{id}/keys", s.GetDeviceKeys)
+	router.HandleFunc(http.MethodPost, "/api/v0/device/{id}/keys", s.RotateDeviceKey)
+	router.HandleFunc(http.MethodGet, "/api/v0/device/{id}/chain/verify", s.VerifyDeviceChain)
+	router.HandleFunc(http.MethodPost, "/api/v0/sign", s.CreateSigning)
+	router.HandleFunc(http.MethodGet, "/api/v0/signings", s.GetAllSignings)
+	router.HandleFunc(http.MethodPost, "/api/v0/verify", s.VerifySignature)
+
+	return router
+}
+
+const contentTypeProblem = "application/problem+json"
 
-	return http.ListenAndServe(s.listenAddress, mux)
+// Problem is an RFC 7807 problem details object, Code is the stable error code clients branch on.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
 }
 
-// WriteErrorResponse takes an HTTP status code and a slice of errors
-// and writes those as an HTTP error response in a structured format.
-func WriteErrorResponse(w http.ResponseWriter, status int, err error, message string) {
+// problemStatus maps the kinds of services.ServiceError to the status of the response.
+var problemStatus = map[services.ErrorKind]int{
+	services.ErrorKindValidation:         http.StatusUnprocessableEntity,
+	services.ErrorKindNotFound:           http.StatusNotFound,
+	services.ErrorKindConflict:           http.StatusConflict,
+	services.ErrorKindPreconditionFailed: http.StatusPreconditionFailed,
+	services.ErrorKindInternal:           http.StatusInternalServerError,
+}
 
+// statusCodes are the error codes of the problems the handlers report themselves, before a service is involved.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           "bad_request",
+	http.StatusNotFound:             "not_found",
+	http.StatusMethodNotAllowed:     "method_not_allowed",
+	http.StatusNotAcceptable:        "not_acceptable",
+	http.StatusPreconditionFailed:   "precondition_failed",
+	http.StatusUnsupportedMediaType: "unsupported_media_type",
+	http.StatusUnprocessableEntity:  "unprocessable_entity",
+	http.StatusInternalServerError:  services.CodeInternal,
+}
+
+// WriteErrorResponse writes an RFC 7807 problem. A services.ServiceError in err decides the status, the code and the
+// detail; any other error is internal, it is logged and the client only gets the status and message.
+func WriteErrorResponse(w http.ResponseWriter, status int, err error, message string) {
+	code := statusCodes[status]
 	if err != nil {
 		logrus.Error(err)
 
-		// custom db-level error
-		var dbError *services.DBError
-		if errors.As(err, &dbError) {
-			status = http.StatusBadRequest
-			message = err.Error()
-		}
-
-		// validation error
-		var badRequest *services.ServiceError
-		if errors.As(err, &badRequest) {
-			status = badRequest.Status
-			message = err.Error()
+		var serviceError *services.ServiceError
+		if errors.As(err, &serviceError) {
+			status = problemStatus[serviceError.Kind]
+			code = serviceError.Code
+			message = serviceError.Error()
 		}
-
+	}
+	if code == "" {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
 	}
 
+	w.Header().Set("Content-Type", contentTypeProblem)
 	w.WriteHeader(status)
 
-	bytes, err := json.Marshal(Response[string]{
-		Err: message,
+	bytes, err := json.Marshal(Problem{
+		Type:   "urn:signing-service:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: message,
+		Code:   code,
 	})
 	if err != nil {
 		logrus.WithError(err).Error("error marshalling error response")
@@ -99,6 +168,7 @@ func WriteErrorResponse(w http.ResponseWriter, status int, err error, message st
 // WriteAPIResponse takes an HTTP status code and a generic data struct
 // and writes those as an HTTP response in a structured format.
 func WriteAPIResponse[T any](w http.ResponseWriter, statusCode int, data T) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
 	response := Response[T]{
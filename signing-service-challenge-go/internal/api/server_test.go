@@ -0,0 +1,154 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+func TestWriteErrorResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		err            error
+		message        string
+		expectedStatus int
+		expectedCode   string
+		expectedDetail string
+	}{
+		{
+			name:           "Validation error",
+			status:         http.StatusInternalServerError,
+			err:            services.NewValidationError(services.CodeInvalidAlgorithm, "unsupported algorithm"),
+			message:        "Internal Server Error",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   services.CodeInvalidAlgorithm,
+			expectedDetail: "unsupported algorithm",
+		},
+		{
+			name:           "Not found error",
+			status:         http.StatusInternalServerError,
+			err:            services.NewNotFoundError(services.CodeDeviceNotFound, "device not found"),
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   services.CodeDeviceNotFound,
+			expectedDetail: "device not found",
+		},
+		{
+			name:           "Conflict error",
+			status:         http.StatusInternalServerError,
+			err:            services.NewConflictError(services.CodeDeviceExists, "device already exists"),
+			expectedStatus: http.StatusConflict,
+			expectedCode:   services.CodeDeviceExists,
+			expectedDetail: "device already exists",
+		},
+		{
+			name:           "Precondition failed error",
+			status:         http.StatusInternalServerError,
+			err:            services.NewPreconditionFailedError(services.CodeDeviceModified, "device was modified"),
+			expectedStatus: http.StatusPreconditionFailed,
+			expectedCode:   services.CodeDeviceModified,
+			expectedDetail: "device was modified",
+		},
+		{
+			name:           "Internal error",
+			status:         http.StatusBadRequest,
+			err:            services.NewInternalError(services.CodeInternal, "storage unavailable"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   services.CodeInternal,
+			expectedDetail: "storage unavailable",
+		},
+		{
+			name:           "Wrapped service error",
+			status:         http.StatusInternalServerError,
+			err:            fmt.Errorf("loading device: %w", services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")),
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   services.CodeDeviceNotFound,
+			expectedDetail: "device not found",
+		},
+		{
+			name:           "Other errors keep their details in the log",
+			status:         http.StatusInternalServerError,
+			err:            errors.New("pq: connection refused"),
+			message:        "Internal Server Error",
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   services.CodeInternal,
+			expectedDetail: "Internal Server Error",
+		},
+		{
+			name:           "Handler error",
+			status:         http.StatusUnsupportedMediaType,
+			message:        "Patches have to be sent as application/merge-patch+json",
+			expectedStatus: http.StatusUnsupportedMediaType,
+			expectedCode:   "unsupported_media_type",
+			expectedDetail: "Patches have to be sent as application/merge-patch+json",
+		},
+		{
+			name:           "Handler error without a code of its own",
+			status:         http.StatusTooManyRequests,
+			message:        "Slow down",
+			expectedStatus: http.StatusTooManyRequests,
+			expectedCode:   "too_many_requests",
+			expectedDetail: "Slow down",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			recorder := httptest.NewRecorder()
+
+			// execute
+			WriteErrorResponse(recorder, test.status, test.err, test.message)
+
+			// asserts
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			problem := decodeProblem(t, recorder)
+			assert.Equal(t, Problem{
+				Type:   "urn:signing-service:problem:" + test.expectedCode,
+				Title:  http.StatusText(test.expectedStatus),
+				Status: test.expectedStatus,
+				Detail: test.expectedDetail,
+				Code:   test.expectedCode,
+			}, problem)
+		})
+	}
+}
+
+func TestMetricsStayOffTheAPI(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        http.Handler
+		expectedStatus int
+	}{
+		{
+			name:           "API listener",
+			handler:        NewServer("", nil, nil, nil).Routes(),
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Metrics listener",
+			handler:        MetricsRoutes(),
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			recorder := httptest.NewRecorder()
+
+			// execute
+			test.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+
+			// asserts
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if test.expectedStatus == http.StatusOK {
+				assert.Contains(t, recorder.Body.String(), `"memstats"`)
+			}
+		})
+	}
+}
@@ -4,67 +4,79 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
 )
 
 type SigningInputDTO struct {
-	DeviceID string `json:"device_id"`
-	Data     string `json:"data"`
+	DeviceID string            `json:"device_id"`
+	Data     string            `json:"data"`
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type SigningResultDTO struct {
+	Id         string `json:"id,omitempty"`
+	DeviceId   string `json:"device_id,omitempty"`
+	Counter    int64  `json:"counter,omitempty"`
 	Signature  string `json:"signature"`
 	SignedData string `json:"signed_data"`
+	KeyID      string `json:"key_id,omitempty"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	// CreatedAt is missing on signings stored before it was recorded
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
 func (s *Server) CreateSigning(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodPost {
-		WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
-		return
-	}
-
 	var input SigningInputDTO
 	if err := json.NewDecoder(request.Body).Decode(&input); err != nil {
 		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid request payload")
 		return
 	}
+	// the device is part of the path of /devices/{id}/signatures, device_id can be left out there
+	if deviceId := PathParam(request, "id"); deviceId != "" {
+		if input.DeviceID != "" && input.DeviceID != deviceId {
+			WriteErrorResponse(response, http.StatusBadRequest, nil, "device_id doesn't match the device of the path")
+			return
+		}
+		input.DeviceID = deviceId
+	}
 
-	signature, signedData, err := s.signatureService.Sign(input.DeviceID, []byte(input.Data))
+	signing, err := s.signatureService.Sign(input.DeviceID, []byte(input.Data), input.Metadata)
 	if err != nil {
 		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
 		return
 	}
-
-	output := SigningResultDTO{
-		Signature:  signature,
-		SignedData: signedData,
-	}
-	WriteAPIResponse(response, http.StatusCreated, output)
+	WriteAPIResponse(response, http.StatusCreated, convertSigningDomainModelToDTO(signing))
 }
 
+// GetAllSignings pages through the signings of a device by pageNr, or by cursor when pageNr is left out.
 func (s *Server) GetAllSignings(response http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		WriteErrorResponse(response, http.StatusMethodNotAllowed, nil, http.StatusText(http.StatusMethodNotAllowed))
-		return
+	deviceId := PathParam(request, "id")
+	if deviceId == "" {
+		deviceId = request.URL.Query().Get("deviceId")
 	}
-	deviceId := request.URL.Query().Get("deviceId")
 	if deviceId == "" {
 		WriteErrorResponse(response, http.StatusBadRequest, nil, "Invalid or missing deviceId")
 		return
 	}
 
-	pageNr, err := strconv.Atoi(request.URL.Query().Get("pageNr"))
-	if err != nil || pageNr < 1 {
-		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid or missing pageNr")
-		return
-	}
-
 	pageSize, err := strconv.Atoi(request.URL.Query().Get("pageSize"))
 	if err != nil || pageSize < 1 {
 		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid or missing pageSize")
 		return
 	}
+	if !request.URL.Query().Has("pageNr") {
+		s.getSigningsPage(response, request, deviceId, pageSize)
+		return
+	}
+
+	pageNr, err := strconv.Atoi(request.URL.Query().Get("pageNr"))
+	if err != nil || pageNr < 1 {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid or missing pageNr")
+		return
+	}
 
 	list, totalCount, err := s.signatureService.GetAllSignings(deviceId, pageNr, pageSize)
 	if err != nil {
@@ -76,26 +88,92 @@ func (s *Server) GetAllSignings(response http.ResponseWriter, request *http.Requ
 	WriteAPIResponse(response, http.StatusOK, output)
 }
 
+func (s *Server) getSigningsPage(response http.ResponseWriter, request *http.Request, deviceId string, pageSize int) {
+	cursor, err := decodeCursor(request.URL.Query().Get("cursor"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid cursor")
+		return
+	}
+
+	page, err := s.signatureService.GetSigningsPage(deviceId, cursor, pageSize)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, "Failed to retrieve signings")
+		return
+	}
+
+	output := &PaginatedResponse[SigningResultDTO]{
+		PageSize: pageSize,
+		Next:     encodeCursor(page.Next),
+		Prev:     encodeCursor(page.Prev),
+		Items:    []SigningResultDTO{},
+	}
+	for _, signing := range page.Items {
+		output.Items = append(output.Items, convertSigningDomainModelToDTO(signing))
+	}
+	WriteAPIResponse(response, http.StatusOK, output)
+}
+
+// GetSigning returns the signing of a device by its counter.
+func (s *Server) GetSigning(response http.ResponseWriter, request *http.Request) {
+	counter, err := strconv.ParseInt(PathParam(request, "counter"), 10, 64)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid counter")
+		return
+	}
+
+	signing, err := s.signatureService.GetSigning(PathParam(request, "id"), counter)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, convertSigningDomainModelToDTO(signing))
+}
+
+// GetSigningByID returns a signing by its id.
+func (s *Server) GetSigningByID(response http.ResponseWriter, request *http.Request) {
+	signing, err := s.signatureService.GetSigningByID(PathParam(request, "signatureId"))
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, convertSigningDomainModelToDTO(signing))
+}
+
+func convertSigningDomainModelToDTO(input *domain.Signings) SigningResultDTO {
+	output := SigningResultDTO{
+		Id:         input.ID,
+		DeviceId:   input.DeviceId,
+		Counter:    input.Counter,
+		Signature:  input.Signature,
+		SignedData: input.SignedData,
+		KeyID:      input.KeyID,
+		Algorithm:  string(input.Algorithm),
+		Metadata:   input.Metadata,
+	}
+	if !input.CreatedAt.IsZero() {
+		createdAt := input.CreatedAt
+		output.CreatedAt = &createdAt
+	}
+	return output
+}
+
 func convertSigningListDomainModelToDTO(i *[]*domain.Signings, page int, size int, total int) *PaginatedResponse[SigningResultDTO] {
 	if i == nil {
 		return &PaginatedResponse[SigningResultDTO]{
 			Items: nil,
-			Total: total,
+			Total: &total,
 		}
 	}
 
-	var items []SigningResultDTO
+	items := []SigningResultDTO{}
 	for _, item := range *i {
 		if item != nil {
-			items = append(items, SigningResultDTO{
-				Signature:  item.Signature,
-				SignedData: item.SignedData,
-			})
+			items = append(items, convertSigningDomainModelToDTO(item))
 		}
 	}
 	return &PaginatedResponse[SigningResultDTO]{
 		Items:      items,
-		Total:      total,
+		Total:      &total,
 		PageNumber: page,
 		PageSize:   size,
 	}
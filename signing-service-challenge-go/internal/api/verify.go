@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type VerifyInputDTO struct {
+	DeviceID   string `json:"device_id"`
+	SignedData string `json:"signed_data"`
+	Signature  string `json:"signature"`
+}
+
+type VerifyResultDTO struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type ChainVerifyResultDTO struct {
+	DeviceID      string `json:"device_id"`
+	Valid         bool   `json:"valid"`
+	VerifiedCount int    `json:"verified_count"`
+	BrokenCounter int64  `json:"broken_counter,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+func (s *Server) VerifySignature(response http.ResponseWriter, request *http.Request) {
+	var input VerifyInputDTO
+	if err := json.NewDecoder(request.Body).Decode(&input); err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, err, "Invalid request payload")
+		return
+	}
+
+	valid, reason, err := s.verifyService.Verify(input.DeviceID, input.SignedData, input.Signature)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	output := VerifyResultDTO{
+		Valid:  valid,
+		Reason: reason,
+	}
+	WriteAPIResponse(response, http.StatusOK, output)
+}
+
+func (s *Server) VerifyDeviceChain(response http.ResponseWriter, request *http.Request) {
+	deviceId := PathParam(request, "id")
+
+	result, err := s.verifyService.VerifyChain(deviceId)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusInternalServerError, err, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	output := ChainVerifyResultDTO{
+		DeviceID:      deviceId,
+		Valid:         result.Valid,
+		VerifiedCount: result.VerifiedCount,
+		BrokenCounter: result.BrokenCounter,
+		Reason:        result.Reason,
+	}
+	WriteAPIResponse(response, http.StatusOK, output)
+}
@@ -1,13 +1,127 @@
 package configuration
 
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
 // Configuration will hold our internal configuration settings
 type Configuration struct {
 	ListenAddress string `json:"listen_address"`
+	// MetricsListenAddress is where the expvar metrics are served, apart from the API as they describe the process
+	MetricsListenAddress string `json:"metrics_listen_address"`
+	// DeviceIDPolicy selects the device ids clients may choose: "safe" (default) or "uuid"
+	DeviceIDPolicy string `json:"device_id_policy"`
+	// Storage selects where devices and signings are kept: "memory" (default), "postgres" or "sqlite"
+	Storage string `json:"storage"`
+	// DatabaseURL is the connection string of the postgres storage
+	DatabaseURL string `json:"-"`
+	// SQLitePath is the database file of the sqlite storage
+	SQLitePath string `json:"sqlite_path"`
+	// JournalDir makes the memory storage durable by journaling its writes there, the journal is off when it is empty
+	JournalDir string `json:"journal_dir"`
+	// JournalSync is when the journal is fsynced: "always" (default), "interval" or "never"
+	JournalSync string `json:"journal_sync"`
+	// JournalSyncInterval is the fsync period of the "interval" policy
+	JournalSyncInterval time.Duration `json:"journal_sync_interval"`
+	// JournalCompactEvery is the number of journal records after which a snapshot is written, 0 disables compaction
+	JournalCompactEvery int `json:"journal_compact_every"`
+	// KeyStore selects where the private keys live: "memory" (default) or "file"
+	KeyStore string `json:"key_store"`
+	// KeyStorePath is the directory of the file key store
+	KeyStorePath string `json:"key_store_path"`
+	// KeyCacheSize is the number of decoded private keys the file key store keeps in memory, 0 disables the cache
+	KeyCacheSize int `json:"key_cache_size"`
+	// KeyEncryptionKeys holds the KEKs used by the file key store to encrypt the private keys at rest as
+	// "<id>=<base64 key>" entries, the first one being the active KEK. Private keys are stored unencrypted when it is empty.
+	KeyEncryptionKeys string `json:"-"`
 }
 
 // LoadConfiguration in real live we would load the env file here, some other way of getting the env variables
 func LoadConfiguration() (*Configuration, error) {
-	return &Configuration{
-		ListenAddress: ":8080",
-	}, nil
+	keyEncryptionKeys, err := loadKeyEncryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	journalSyncInterval, err := time.ParseDuration(getEnv("JOURNAL_SYNC_INTERVAL", "1s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JOURNAL_SYNC_INTERVAL: %v", err)
+	}
+	journalCompactEvery, err := strconv.Atoi(getEnv("JOURNAL_COMPACT_EVERY", "10000"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JOURNAL_COMPACT_EVERY: %v", err)
+	}
+	keyCacheSize, err := strconv.Atoi(getEnv("KEY_CACHE_SIZE", "1024"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KEY_CACHE_SIZE: %v", err)
+	}
+
+	config := &Configuration{
+		ListenAddress:        ":8080",
+		MetricsListenAddress: getEnv("METRICS_LISTEN_ADDRESS", "localhost:9090"),
+		DeviceIDPolicy:       getEnv("DEVICE_ID_POLICY", "safe"),
+		Storage:              getEnv("STORAGE", "memory"),
+		DatabaseURL:          os.Getenv("DATABASE_URL"),
+		SQLitePath:           getEnv("SQLITE_PATH", "./data/signservice.db"),
+		JournalDir:           os.Getenv("JOURNAL_DIR"),
+		JournalSync:          getEnv("JOURNAL_SYNC", "always"),
+		JournalSyncInterval:  journalSyncInterval,
+		JournalCompactEvery:  journalCompactEvery,
+		KeyStore:             getEnv("KEY_STORE", "memory"),
+		KeyStorePath:         getEnv("KEY_STORE_PATH", "./data/keys"),
+		KeyCacheSize:         keyCacheSize,
+		KeyEncryptionKeys:    keyEncryptionKeys,
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate rejects combinations of settings that don't do what they seem to.
+func (c *Configuration) Validate() error {
+	if c.KeyStore == "memory" && c.KeyEncryptionKeys != "" {
+		return errors.New("key encryption keys are only used by the file key store, set KEY_STORE=file")
+	}
+	// the devices would outlive their private keys and could never sign again after a restart
+	if c.KeyStore == "memory" && c.durableStorage() {
+		return errors.New("the storage keeps devices across restarts but the memory key store loses their keys, set KEY_STORE=file")
+	}
+	return nil
+}
+
+// durableStorage tells whether the devices survive a restart.
+func (c *Configuration) durableStorage() bool {
+	switch c.Storage {
+	case "postgres", "sqlite":
+		return true
+	case "memory":
+		return c.JournalDir != ""
+	default:
+		return false
+	}
+}
+
+// loadKeyEncryptionKeys takes the KEKs from the file named by KEY_ENCRYPTION_KEYS_FILE (one per line)
+// or else from the KEY_ENCRYPTION_KEYS env variable (comma separated).
+func loadKeyEncryptionKeys() (string, error) {
+	if path := os.Getenv("KEY_ENCRYPTION_KEYS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	}
+	return os.Getenv("KEY_ENCRYPTION_KEYS"), nil
+}
+
+func getEnv(key string, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists && value != "" {
+		return value
+	}
+	return fallback
 }
@@ -0,0 +1,67 @@
+package configuration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	storageError := "the storage keeps devices across restarts but the memory key store loses their keys, set KEY_STORE=file"
+	tests := []struct {
+		name          string
+		config        Configuration
+		expectedError string
+	}{
+		{
+			name:   "memory storage and key store",
+			config: Configuration{Storage: "memory", KeyStore: "memory"},
+		},
+		{
+			name:   "file key store with key encryption keys",
+			config: Configuration{Storage: "memory", KeyStore: "file", KeyEncryptionKeys: "kek-1=a2V5"},
+		},
+		{
+			name:   "sqlite with file key store",
+			config: Configuration{Storage: "sqlite", KeyStore: "file"},
+		},
+		{
+			name:          "sqlite with memory key store",
+			config:        Configuration{Storage: "sqlite", KeyStore: "memory"},
+			expectedError: storageError,
+		},
+		{
+			name:          "postgres with memory key store",
+			config:        Configuration{Storage: "postgres", KeyStore: "memory"},
+			expectedError: storageError,
+		},
+		{
+			name:          "memory key store with key encryption keys",
+			config:        Configuration{Storage: "memory", KeyStore: "memory", KeyEncryptionKeys: "kek-1=a2V5"},
+			expectedError: "key encryption keys are only used by the file key store, set KEY_STORE=file",
+		},
+		{
+			name:   "journal with file key store",
+			config: Configuration{Storage: "memory", JournalDir: "./data/journal", KeyStore: "file"},
+		},
+		{
+			name:          "journal with memory key store",
+			config:        Configuration{Storage: "memory", JournalDir: "./data/journal", KeyStore: "memory"},
+			expectedError: storageError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// execute
+			err := tt.config.Validate()
+
+			// asserts
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expectedError)
+			}
+		})
+	}
+}
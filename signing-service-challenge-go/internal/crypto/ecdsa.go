@@ -1,12 +1,16 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 )
@@ -17,11 +21,29 @@ type ECCKeyPair struct {
 	Private *ecdsa.PrivateKey
 }
 
+// hashForCurve matches the digest strength to the curve: SHA-256 for P-256, SHA-384 for P-384 and SHA-512 for P-521.
+func hashForCurve(curve elliptic.Curve) crypto.Hash {
+	switch bitSize := curve.Params().BitSize; {
+	case bitSize > 384:
+		return crypto.SHA512
+	case bitSize > 256:
+		return crypto.SHA384
+	default:
+		return crypto.SHA256
+	}
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	hasher := hash.New()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
 func (kp *ECCKeyPair) Sign(data []byte) ([]byte, error) {
-	hash := sha256.Sum256(data)
+	hash := digest(hashForCurve(kp.Private.Curve), data)
 
 	// Sign the hash
-	r, s, err := ecdsa.Sign(rand.Reader, kp.Private, hash[:])
+	r, s, err := ecdsa.Sign(rand.Reader, kp.Private, hash)
 	if err != nil {
 		return nil, fmt.Errorf("signing failed: %v", err)
 	}
@@ -42,7 +64,7 @@ func (kp *ECCKeyPair) Sign(data []byte) ([]byte, error) {
 
 func (kp *ECCKeyPair) VerifySignature(data []byte, signature []byte) error {
 	// Hash the original data
-	hash := sha256.Sum256(data)
+	hash := digest(hashForCurve(kp.Public.Curve), data)
 
 	// Unmarshal the signature
 	var sigStruct struct {
@@ -54,7 +76,7 @@ func (kp *ECCKeyPair) VerifySignature(data []byte, signature []byte) error {
 	}
 
 	// Verify the signature
-	if !ecdsa.Verify(kp.Public, hash[:], sigStruct.R, sigStruct.S) {
+	if !ecdsa.Verify(kp.Public, hash, sigStruct.R, sigStruct.S) {
 		return fmt.Errorf("signature verification failed")
 	}
 
@@ -109,3 +131,23 @@ func (m *ECCMarshaler) Decode(privateKeyBytes []byte) (Signer, error) {
 		Public:  &privateKey.PublicKey,
 	}, nil
 }
+
+// DecodePublic assembles an ECCKeyPair holding only the public key, usable for verification.
+func (m *ECCMarshaler) DecodePublic(publicKeyBytes []byte) (Verifier, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid public key encoding")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an ECDSA key")
+	}
+
+	return &ECCKeyPair{
+		Public: publicKey,
+	}, nil
+}
@@ -0,0 +1,104 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Ed25519KeyPair is a DTO that holds Ed25519 private and public keys.
+type Ed25519KeyPair struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+func (kp *Ed25519KeyPair) Sign(data []byte) ([]byte, error) {
+	// Ed25519 hashes the message internally, so there is no pre-hashing here
+	return ed25519.Sign(kp.Private, data), nil
+}
+
+func (kp *Ed25519KeyPair) VerifySignature(data []byte, signature []byte) error {
+	if !ed25519.Verify(kp.Public, data, signature) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	return nil
+}
+
+// Ed25519Marshaler can encode and decode an Ed25519 key pair.
+type Ed25519Marshaler struct{}
+
+// NewEd25519Marshaler creates a new Ed25519Marshaler.
+func NewEd25519Marshaler() *Ed25519Marshaler {
+	return &Ed25519Marshaler{}
+}
+
+// Encode takes an Ed25519KeyPair and encodes it to be written on disk.
+// It returns the public (PKIX) and the private (PKCS#8) key as a byte slice.
+func (m *Ed25519Marshaler) Encode(keyPair Signer) ([]byte, []byte, error) {
+	input := keyPair.(*Ed25519KeyPair)
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(input.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(input.Public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encodedPrivate := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE_KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	encodedPublic := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC_KEY",
+		Bytes: publicKeyBytes,
+	})
+
+	return encodedPublic, encodedPrivate, nil
+}
+
+// Decode assembles an Ed25519KeyPair from an encoded private key.
+func (m *Ed25519Marshaler) Decode(privateKeyBytes []byte) (Signer, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid private key encoding")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an Ed25519 key")
+	}
+
+	return &Ed25519KeyPair{
+		Private: privateKey,
+		Public:  privateKey.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// DecodePublic assembles an Ed25519KeyPair holding only the public key, usable for verification.
+func (m *Ed25519Marshaler) DecodePublic(publicKeyBytes []byte) (Verifier, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid public key encoding")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+
+	return &Ed25519KeyPair{
+		Public: publicKey,
+	}, nil
+}
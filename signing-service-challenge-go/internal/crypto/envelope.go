@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeyEncryptionKey is a named AES-256 key used to wrap the private keys of the devices at rest.
+type KeyEncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// ParseKeyEncryptionKeys reads KEKs written as "<id>=<base64 key>", separated by commas or new lines.
+// The first KEK is the active one, the others are only kept to unwrap keys that were not re-wrapped yet.
+func ParseKeyEncryptionKeys(input string) ([]KeyEncryptionKey, error) {
+	var keys []KeyEncryptionKey
+	entries := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, "=")
+		if !found || strings.TrimSpace(id) == "" {
+			return nil, errors.New("key encryption keys must be written as <id>=<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("key encryption key %s is not valid base64: %v", id, err)
+		}
+		keys = append(keys, KeyEncryptionKey{ID: strings.TrimSpace(id), Key: key})
+	}
+	return keys, nil
+}
+
+// Keyring wraps and unwraps private keys with AES-GCM. New keys are always wrapped with the active KEK.
+type Keyring struct {
+	activeID string
+	aeads    map[string]cipher.AEAD
+}
+
+// NewKeyring creates a Keyring whose active KEK is the first of keys.
+func NewKeyring(keys []KeyEncryptionKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key encryption key is required")
+	}
+
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for _, kek := range keys {
+		if len(kek.Key) != 32 {
+			return nil, fmt.Errorf("key encryption key %s must be 32 bytes long", kek.ID)
+		}
+		if _, exists := aeads[kek.ID]; exists {
+			return nil, fmt.Errorf("duplicated key encryption key id %s", kek.ID)
+		}
+		block, err := aes.NewCipher(kek.Key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[kek.ID] = aead
+	}
+
+	return &Keyring{
+		activeID: keys[0].ID,
+		aeads:    aeads,
+	}, nil
+}
+
+// ActiveID returns the id of the KEK used for wrapping.
+func (k *Keyring) ActiveID() string {
+	return k.activeID
+}
+
+// Wrap encrypts plaintext with the active KEK. associatedData binds the ciphertext to its owner,
+// so a wrapped key copied to another device can't be unwrapped. It returns nonce||ciphertext and the KEK id.
+func (k *Keyring) Wrap(plaintext []byte, associatedData []byte) ([]byte, string, error) {
+	aead := k.aeads[k.activeID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), k.activeID, nil
+}
+
+// Unwrap decrypts a value produced by Wrap with the KEK it was wrapped with.
+func (k *Keyring) Unwrap(ciphertext []byte, kekID string, associatedData []byte) ([]byte, error) {
+	aead, exists := k.aeads[kekID]
+	if !exists {
+		return nil, fmt.Errorf("unknown key encryption key %s", kekID)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key with %s: %v", kekID, err)
+	}
+	return plaintext, nil
+}
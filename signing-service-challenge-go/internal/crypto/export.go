@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+// JWK is the JSON Web Key (RFC 7517) representation of a public key.
+// Only the members of the key type are set: n/e for RSA, crv/x/y for EC and crv/x for OKP. alg is only set when the
+// signatures are what the JWS algorithm (RFC 7518) expects: ECDSA signatures are ASN.1 DER rather than R||S and PSS
+// signatures use the longest salt rather than the hash length, so EC and RSA PSS keys have none.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// MarshalPublicKeyDER encodes the public key of the verifier as a DER SubjectPublicKeyInfo, whatever the algorithm.
+func MarshalPublicKeyDER(verifier Verifier) ([]byte, error) {
+	switch key := verifier.(type) {
+	case *ECCKeyPair:
+		return x509.MarshalPKIXPublicKey(key.Public)
+	case *RSAKeyPair:
+		return x509.MarshalPKIXPublicKey(key.Public)
+	case *Ed25519KeyPair:
+		return x509.MarshalPKIXPublicKey(key.Public)
+	default:
+		return nil, errors.New("unknown key type")
+	}
+}
+
+// MarshalPublicKeyPEM encodes the public key of the verifier as a standard "PUBLIC KEY" PEM block.
+func MarshalPublicKeyPEM(verifier Verifier) ([]byte, error) {
+	der, err := MarshalPublicKeyDER(verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
+// MarshalPublicKeyJWK converts the public key of the verifier into a JWK identified by kid.
+func MarshalPublicKeyJWK(verifier Verifier, kid string) (*JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch key := verifier.(type) {
+	case *ECCKeyPair:
+		publicKey, err := key.Public.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		// uncompressed point: 0x04 || X || Y, both coordinates padded to the field size
+		point := publicKey.Bytes()
+		size := (len(point) - 1) / 2
+		return &JWK{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: key.Public.Curve.Params().Name,
+			X:   encode(point[1 : 1+size]),
+			Y:   encode(point[1+size:]),
+		}, nil
+	case *RSAKeyPair:
+		alg := ""
+		if key.Padding == domain.PaddingTypePKCS1v15 {
+			alg = "RS256"
+		}
+		return &JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			N:   encode(key.Public.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.Public.E)).Bytes()),
+		}, nil
+	case *Ed25519KeyPair:
+		return &JWK{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Alg: "EdDSA",
+			Crv: "Ed25519",
+			X:   encode(key.Public),
+		}, nil
+	default:
+		return nil, errors.New("unknown key type")
+	}
+}
@@ -0,0 +1,109 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+func TestPublicKeyExport(t *testing.T) {
+	tests := []struct {
+		name        string
+		tp          domain.AlgorithmType
+		options     domain.AlgorithmOptions
+		expectedKty string
+		expectedCrv string
+		expectedAlg string
+	}{
+		{
+			name:        "ECC P-256",
+			tp:          domain.AlgorithmTypeECC,
+			options:     domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+			expectedKty: "EC",
+			expectedCrv: "P-256",
+		},
+		{
+			name:        "ECC P-521",
+			tp:          domain.AlgorithmTypeECC,
+			options:     domain.AlgorithmOptions{Curve: domain.CurveTypeP521},
+			expectedKty: "EC",
+			expectedCrv: "P-521",
+		},
+		{
+			name:        "RSA PSS",
+			tp:          domain.AlgorithmTypeRSA,
+			expectedKty: "RSA",
+		},
+		{
+			name:        "RSA PKCS1v15",
+			tp:          domain.AlgorithmTypeRSA,
+			options:     domain.AlgorithmOptions{Padding: domain.PaddingTypePKCS1v15},
+			expectedKty: "RSA",
+			expectedAlg: "RS256",
+		},
+		{
+			name:        "Ed25519",
+			tp:          domain.AlgorithmTypeEd25519,
+			expectedKty: "OKP",
+			expectedCrv: "Ed25519",
+			expectedAlg: "EdDSA",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			factory := NewFactory()
+			keyPair, err := factory.GenerateAlgorithm(test.tp, test.options)
+			assert.NoError(t, err)
+			verifier := keyPair.(Verifier)
+
+			// PEM and DER have to carry the same SubjectPublicKeyInfo
+			der, err := MarshalPublicKeyDER(verifier)
+			assert.NoError(t, err)
+			encodedPem, err := MarshalPublicKeyPEM(verifier)
+			assert.NoError(t, err)
+			block, _ := pem.Decode(encodedPem)
+			assert.Equal(t, "PUBLIC KEY", block.Type)
+			assert.Equal(t, der, block.Bytes)
+			parsed, err := x509.ParsePKIXPublicKey(der)
+			assert.NoError(t, err)
+
+			// the JWK members have to rebuild the same key
+			jwk, err := MarshalPublicKeyJWK(verifier, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "device-1", jwk.Kid)
+			assert.Equal(t, test.expectedKty, jwk.Kty)
+			assert.Equal(t, test.expectedCrv, jwk.Crv)
+			assert.Equal(t, test.expectedAlg, jwk.Alg)
+			switch key := parsed.(type) {
+			case *ecdsa.PublicKey:
+				assert.Equal(t, 0, key.X.Cmp(decodeJWKInt(t, jwk.X)))
+				assert.Equal(t, 0, key.Y.Cmp(decodeJWKInt(t, jwk.Y)))
+			case *rsa.PublicKey:
+				assert.Equal(t, 0, key.N.Cmp(decodeJWKInt(t, jwk.N)))
+				assert.Equal(t, int64(key.E), decodeJWKInt(t, jwk.E).Int64())
+			case ed25519.PublicKey:
+				x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+				assert.NoError(t, err)
+				assert.Equal(t, []byte(key), x)
+			default:
+				t.Errorf("unexpected key type %T", parsed)
+			}
+		})
+	}
+}
+
+func decodeJWKInt(t *testing.T, value string) *big.Int {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	assert.NoError(t, err)
+	return new(big.Int).SetBytes(decoded)
+}
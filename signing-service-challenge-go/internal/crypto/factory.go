@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto/elliptic"
 	"errors"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
@@ -9,6 +10,7 @@ import (
 type AlgorithmMarshaller interface {
 	Encode(input Signer) ([]byte, []byte, error)
 	Decode(input []byte) (Signer, error)
+	DecodePublic(input []byte) (Verifier, error)
 }
 
 type Factory struct{}
@@ -17,26 +19,51 @@ func NewFactory() *Factory {
 	return &Factory{}
 }
 
-func (f *Factory) CreateMarshaller(input domain.AlgorithmType) (AlgorithmMarshaller, error) {
+func (f *Factory) CreateMarshaller(input domain.AlgorithmType, options domain.AlgorithmOptions) (AlgorithmMarshaller, error) {
 	switch input {
 	case domain.AlgorithmTypeECC:
 		return NewECCMarshaler(), nil
 	case domain.AlgorithmTypeRSA:
-		return NewRSAMarshaler(), nil
+		return NewRSAMarshaler(options.Padding), nil
+	case domain.AlgorithmTypeEd25519:
+		return NewEd25519Marshaler(), nil
 	default:
 		return nil, errors.New("unknown algorithm type")
 	}
 }
 
-func (f *Factory) GenerateAlgorithm(input domain.AlgorithmType) (Signer, error) {
+func (f *Factory) GenerateAlgorithm(input domain.AlgorithmType, options domain.AlgorithmOptions) (Signer, error) {
 	switch input {
 	case domain.AlgorithmTypeECC:
-		var generator ECCGenerator
+		curve, err := ellipticCurve(options.Curve)
+		if err != nil {
+			return nil, err
+		}
+		generator := ECCGenerator{Curve: curve}
 		return generator.Generate()
 	case domain.AlgorithmTypeRSA:
-		var generator RSAGenerator
+		generator := RSAGenerator{Bits: options.KeySize, Padding: options.Padding}
+		return generator.Generate()
+	case domain.AlgorithmTypeEd25519:
+		var generator Ed25519Generator
 		return generator.Generate()
 	default:
 		return nil, errors.New("unknown algorithm type")
 	}
 }
+
+// ellipticCurve maps the curve of a device to its implementation, an empty curve leaves the choice to the generator.
+func ellipticCurve(curve domain.CurveType) (elliptic.Curve, error) {
+	switch curve {
+	case domain.CurveTypeUnknown:
+		return nil, nil
+	case domain.CurveTypeP256:
+		return elliptic.P256(), nil
+	case domain.CurveTypeP384:
+		return elliptic.P384(), nil
+	case domain.CurveTypeP521:
+		return elliptic.P521(), nil
+	default:
+		return nil, errors.New("unknown curve type")
+	}
+}
@@ -2,18 +2,31 @@ package crypto
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
 )
 
+// DefaultRSAKeySize is used when no key size is requested.
+const DefaultRSAKeySize = 2048
+
 // RSAGenerator generates RSA key pair.
-type RSAGenerator struct{}
+// When no Bits are set, DefaultRSAKeySize is used.
+type RSAGenerator struct {
+	Bits    int
+	Padding domain.PaddingType
+}
 
 // Generate generates a new RSAKeyPair.
 func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := rsa.GenerateKey(rand.Reader, 512)
+	bits := g.Bits
+	if bits == 0 {
+		bits = DefaultRSAKeySize
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, err
 	}
@@ -21,16 +34,23 @@ func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
 	return &RSAKeyPair{
 		Public:  &key.PublicKey,
 		Private: key,
+		Padding: g.Padding,
 	}, nil
 }
 
 // ECCGenerator generates an ECC key pair.
-type ECCGenerator struct{}
+// When no Curve is set, P-384 is used.
+type ECCGenerator struct {
+	Curve elliptic.Curve
+}
 
 // Generate generates a new ECCKeyPair.
 func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	curve := g.Curve
+	if curve == nil {
+		curve = elliptic.P384()
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -40,3 +60,19 @@ func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
 		Private: key,
 	}, nil
 }
+
+// Ed25519Generator generates an Ed25519 key pair.
+type Ed25519Generator struct{}
+
+// Generate generates a new Ed25519KeyPair.
+func (g *Ed25519Generator) Generate() (*Ed25519KeyPair, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ed25519KeyPair{
+		Public:  public,
+		Private: private,
+	}, nil
+}
@@ -7,21 +7,30 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
 )
 
 // RSAKeyPair is a DTO that holds RSA private and public keys.
+// Padding selects the signature scheme, PSS is used when it is not set.
 type RSAKeyPair struct {
 	Public  *rsa.PublicKey
 	Private *rsa.PrivateKey
+	Padding domain.PaddingType
 }
 
 func (kp *RSAKeyPair) Sign(data []byte) ([]byte, error) {
 	hash := sha256.Sum256(data)
+	if kp.Padding == domain.PaddingTypePKCS1v15 {
+		return rsa.SignPKCS1v15(rand.Reader, kp.Private, crypto.SHA256, hash[:])
+	}
+
 	signature, err := rsa.SignPSS(
 		rand.Reader,
 		kp.Private,
-		crypto.SHA256, // we might need to take this from some configuration in the
+		crypto.SHA256,
 		hash[:],
 		&rsa.PSSOptions{
 			SaltLength: rsa.PSSSaltLengthAuto,
@@ -35,15 +44,20 @@ func (kp *RSAKeyPair) VerifySignature(data []byte, signature []byte) error {
 	hash := sha256.Sum256(data)
 
 	// Verify the signature
-	err := rsa.VerifyPSS(
-		kp.Public,
-		crypto.SHA256,
-		hash[:],
-		signature,
-		&rsa.PSSOptions{
-			SaltLength: rsa.PSSSaltLengthAuto,
-		},
-	)
+	var err error
+	if kp.Padding == domain.PaddingTypePKCS1v15 {
+		err = rsa.VerifyPKCS1v15(kp.Public, crypto.SHA256, hash[:], signature)
+	} else {
+		err = rsa.VerifyPSS(
+			kp.Public,
+			crypto.SHA256,
+			hash[:],
+			signature,
+			&rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthAuto,
+			},
+		)
+	}
 
 	if err != nil {
 		return fmt.Errorf("signature verification failed: %v", err)
@@ -53,11 +67,14 @@ func (kp *RSAKeyPair) VerifySignature(data []byte, signature []byte) error {
 }
 
 // RSAMarshaler can encode and decode an RSA key pair.
-type RSAMarshaler struct{}
+// The padding is not part of the encoded key, so the decoded key pairs get the one of the marshaler.
+type RSAMarshaler struct {
+	padding domain.PaddingType
+}
 
 // NewRSAMarshaler creates a new RSAMarshaler.
-func NewRSAMarshaler() *RSAMarshaler {
-	return &RSAMarshaler{}
+func NewRSAMarshaler(padding domain.PaddingType) *RSAMarshaler {
+	return &RSAMarshaler{padding: padding}
 }
 
 // Encode takes an RSAKeyPair and encodes it to be written on disk.
@@ -92,5 +109,23 @@ func (m *RSAMarshaler) Decode(privateKeyBytes []byte) (Signer, error) {
 	return &RSAKeyPair{
 		Private: privateKey,
 		Public:  &privateKey.PublicKey,
+		Padding: m.padding,
+	}, nil
+}
+
+// DecodePublic takes an encoded RSA public key and wraps it into an RSAKeyPair usable for verification.
+func (m *RSAMarshaler) DecodePublic(publicKeyBytes []byte) (Verifier, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid public key encoding")
+	}
+	publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RSAKeyPair{
+		Public:  publicKey,
+		Padding: m.padding,
 	}, nil
 }
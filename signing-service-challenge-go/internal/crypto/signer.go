@@ -3,5 +3,10 @@ package crypto
 // Signer defines a contract for different types of signing implementations.
 type Signer interface {
 	Sign(dataToBeSigned []byte) ([]byte, error)
-	// VerifySignature(data []byte, signature []byte) error // not sure if we will need it here but, it's a convenience to have it for sure
+}
+
+// Verifier defines a contract for checking a signature against the data it was created for.
+// It only needs the public part of a key pair.
+type Verifier interface {
+	VerifySignature(data []byte, signature []byte) error
 }
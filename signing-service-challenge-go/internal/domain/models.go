@@ -1,6 +1,9 @@
 package domain
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -11,36 +14,165 @@ var (
 	AlgorithmTypeUnknown AlgorithmType = ""
 	AlgorithmTypeECC     AlgorithmType = "ECC"
 	AlgorithmTypeRSA     AlgorithmType = "RSA"
+	AlgorithmTypeEd25519 AlgorithmType = "ED25519"
 )
 
+// CurveType will contain all elliptic curves an ECC device can be created with
+type CurveType string
+
+var (
+	CurveTypeUnknown CurveType = ""
+	CurveTypeP256    CurveType = "P-256"
+	CurveTypeP384    CurveType = "P-384"
+	CurveTypeP521    CurveType = "P-521"
+)
+
+// PaddingType will contain all padding schemes an RSA device can sign with
+type PaddingType string
+
+var (
+	PaddingTypeUnknown  PaddingType = ""
+	PaddingTypePSS      PaddingType = "PSS"
+	PaddingTypePKCS1v15 PaddingType = "PKCS1v15"
+)
+
+// DeviceState is where a device is in its lifecycle, only active devices can sign
+type DeviceState string
+
+var (
+	DeviceStateActive         DeviceState = "ACTIVE"
+	DeviceStateSuspended      DeviceState = "SUSPENDED"
+	DeviceStateDecommissioned DeviceState = "DECOMMISSIONED"
+)
+
+// AlgorithmOptions holds the algorithm specific parameters chosen when the device was created.
+// Only the fields that belong to the device algorithm are set.
+type AlgorithmOptions struct {
+	Curve   CurveType
+	KeySize int
+	Padding PaddingType
+}
+
 type Device struct {
 	ID            string
 	AlgorithmType AlgorithmType
+	Options       AlgorithmOptions
 	Label         *string
-	Counter       int64
+	// Metadata holds free-form attributes of the device, maps are replaced on update and never changed in place
+	Metadata map[string]string
+	// Version counts the changes of the editable fields, label and metadata, starting at 1
+	Version int64
+	Counter int64
+
+	// CreatedAt orders the device listings, it is zero for devices journaled before it was recorded
+	CreatedAt time.Time
+
+	State DeviceState
+	// StateChangedAt is when the device left its previous state, zero while it never changed
+	StateChangedAt time.Time
 
-	PublicKey  []byte //storing public key is not needed actually
-	PrivateKey []byte
+	// KeyID, KeyCreatedAt and KeyHandle describe the active key of the device, the one new signings are made with.
+	// KeyHandle references the key pair in the key store, the key material itself never reaches the domain
+	KeyID        string
+	KeyCreatedAt time.Time
+	KeyHandle    string
 }
 
-// DeviceSigner would be in case we want for one device to be able to work with multiple signers and select one of them to work each time you want to sign something.
-// since there is no mentioning of this possibility on the topics I am going to keep things simple and store the keys in the device itself
+// DeviceSigner is one of the key pairs a device has signed with. Rotating the key of a device adds a signer with the
+// next version, which becomes the active one; the older signers are kept so their signatures can still be verified.
 type DeviceSigner struct {
 	ID        string
 	DeviceId  string
-	isValid   bool
+	Version   int
 	CreatedAt time.Time
 
 	AlgorithmType AlgorithmType
-	PublicKey     []byte
-	PrivateKey    []byte
+	Options       AlgorithmOptions
+	KeyHandle     string
 }
 
-// Signings I am not sure if we need this at this time, but for historic reasons I am leaving it here
+// Signings is one entry of the signature chain of a device. Counter numbers the entries of a device from 1 without
+// gaps and SignedData is what was signed: the counter, the data and the signature of the entry before it, which ties
+// the entries together so none can be dropped or reordered unnoticed.
 type Signings struct {
 	ID         string
 	DeviceId   string
 	Counter    int64
 	Signature  string
 	SignedData string
+	// KeyID is the signer the entry was signed with and Algorithm its algorithm
+	KeyID     string
+	Algorithm AlgorithmType
+	// CreatedAt is when the entry was signed, it is zero for signings stored before it was recorded
+	CreatedAt time.Time
+	// Metadata is attached by the client, e.g. the transaction type or an external reference
+	Metadata map[string]string
+}
+
+// SigningDetails is what the caller records with a new signing besides the signature.
+type SigningDetails struct {
+	// Clock stamps CreatedAt while the device is locked, so the times follow the counters. CreatedAt stays zero when it is nil.
+	Clock    func() time.Time
+	Metadata map[string]string
+}
+
+// DeviceNotActiveError is returned when a device that is not active is asked to sign.
+type DeviceNotActiveError struct {
+	State DeviceState
+}
+
+func (e *DeviceNotActiveError) Error() string {
+	return fmt.Sprintf("device is %s, only %s devices can sign", strings.ToLower(string(e.State)), strings.ToLower(string(DeviceStateActive)))
+}
+
+// ErrDeviceExists is returned when a device is saved with the id of a stored device.
+var ErrDeviceExists = errors.New("device already exists")
+
+// SignFunc signs the entry that gets the given counter with the key behind keyHandle, the active key of the device.
+// lastSignature is the signature of the entry before it, empty for the first entry of a device.
+// It returns the signature and the data that was signed.
+type SignFunc func(counter int64, lastSignature string, keyHandle string) (signature string, signedData string, err error)
+
+// DeviceSort is the field a device listing is sorted by, ties are broken by id.
+type DeviceSort string
+
+var (
+	DeviceSortCreatedAt DeviceSort = "created_at"
+	DeviceSortID        DeviceSort = "id"
+	DeviceSortLabel     DeviceSort = "label"
+	DeviceSortCounter   DeviceSort = "signature_counter"
+)
+
+// DeviceFilter narrows and sorts a device listing, fields left at their zero value don't filter.
+// The default sort is by creation time, ascending.
+type DeviceFilter struct {
+	Algorithm AlgorithmType
+	State     DeviceState
+	// Label matches the devices whose label contains it, ignoring case
+	Label string
+	// CreatedFrom and CreatedTo bound the creation time, from is inclusive and to exclusive
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// MinCounter and MaxCounter bound the signature counter, both inclusive
+	MinCounter *int64
+	MaxCounter *int64
+
+	Sort       DeviceSort
+	Descending bool
+}
+
+// PageCursor is a position in a listing ordered by a stable key: devices by CreatedAt then ID, signings by Counter.
+// A forward page holds the items after the position, a backward page the items before it.
+type PageCursor struct {
+	CreatedAt time.Time
+	ID        string
+	Counter   int64
+	Backward  bool
+}
+
+// CursorPage is one page of a cursor based listing in ascending order, Next and Prev are nil at the ends of the list.
+type CursorPage[T any] struct {
+	Items []*T
+	Next  *PageCursor
+	Prev  *PageCursor
 }
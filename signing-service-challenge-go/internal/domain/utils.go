@@ -6,7 +6,18 @@ func ConvertStringToAlgorithmType(input string) AlgorithmType {
 		return AlgorithmTypeECC
 	case "RSA":
 		return AlgorithmTypeRSA
+	case "ED25519":
+		return AlgorithmTypeEd25519
 	default:
 		return AlgorithmTypeUnknown
 	}
 }
+
+func ConvertStringToDeviceState(input string) (DeviceState, bool) {
+	switch state := DeviceState(input); state {
+	case DeviceStateActive, DeviceStateSuspended, DeviceStateDecommissioned:
+		return state, true
+	default:
+		return "", false
+	}
+}
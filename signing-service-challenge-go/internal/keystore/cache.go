@@ -0,0 +1,109 @@
+package keystore
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+)
+
+// SignerCache keeps the most recently used decoded private keys, so signing doesn't unwrap and parse the key
+// every time. It is keyed by key handle, which is as good as keying by device and key version: every version of a
+// device key is generated with a handle of its own that is never reused, so a rotated key gets a new entry instead
+// of replacing the old one, and a destroyed key is evicted.
+type SignerCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recency has the most recently used entry at the front
+	recency *list.List
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// CacheStats are the counters of a SignerCache since it was created.
+type CacheStats struct {
+	Capacity  int    `json:"capacity"`
+	Size      int    `json:"size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type cacheEntry struct {
+	handle string
+	signer crypto.Signer
+}
+
+// NewSignerCache creates a cache holding at most capacity keys, capacity has to be positive.
+func NewSignerCache(capacity int) *SignerCache {
+	return &SignerCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		recency:  list.New(),
+	}
+}
+
+// Get returns the signer cached for handle and counts the hit or the miss.
+func (c *SignerCache) Get(handle string) (crypto.Signer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, exists := c.entries[handle]
+	if !exists {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.recency.MoveToFront(element)
+	return element.Value.(*cacheEntry).signer, true
+}
+
+// Add caches signer for handle, dropping the least recently used key when the cache is full.
+func (c *SignerCache) Add(handle string, signer crypto.Signer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[handle]; exists {
+		element.Value.(*cacheEntry).signer = signer
+		c.recency.MoveToFront(element)
+		return
+	}
+
+	c.entries[handle] = c.recency.PushFront(&cacheEntry{handle: handle, signer: signer})
+	if c.recency.Len() > c.capacity {
+		oldest := c.recency.Back()
+		c.recency.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).handle)
+		c.evictions.Add(1)
+	}
+}
+
+// Evict drops the key of handle, e.g. because it was destroyed.
+func (c *SignerCache) Evict(handle string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[handle]; exists {
+		c.recency.Remove(element)
+		delete(c.entries, handle)
+	}
+}
+
+// Stats returns the counters of the cache, all zero for a nil cache so they can be published when keys aren't cached.
+func (c *SignerCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	size := c.recency.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Capacity:  c.capacity,
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
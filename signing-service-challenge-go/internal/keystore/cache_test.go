@@ -0,0 +1,74 @@
+package keystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+func TestSignerCache(t *testing.T) {
+	// setup
+	cache := NewSignerCache(2)
+	signers := map[string]crypto.Signer{}
+	for _, handle := range []string{"handle-1", "handle-2", "handle-3"} {
+		signer, err := crypto.NewFactory().GenerateAlgorithm(domain.AlgorithmTypeEd25519, domain.AlgorithmOptions{})
+		assert.NoError(t, err)
+		signers[handle] = signer
+	}
+
+	// execute
+	cache.Add("handle-1", signers["handle-1"])
+	cache.Add("handle-2", signers["handle-2"])
+	_, hit := cache.Get("handle-1")
+	assert.True(t, hit)
+	// handle-2 is the least recently used entry now
+	cache.Add("handle-3", signers["handle-3"])
+
+	// asserts
+	_, hit = cache.Get("handle-2")
+	assert.False(t, hit)
+	signer, hit := cache.Get("handle-1")
+	assert.True(t, hit)
+	assert.Same(t, signers["handle-1"], signer)
+
+	cache.Evict("handle-3")
+	_, hit = cache.Get("handle-3")
+	assert.False(t, hit)
+
+	assert.Equal(t, CacheStats{Capacity: 2, Size: 1, Hits: 2, Misses: 2, Evictions: 1}, cache.Stats())
+}
+
+func TestSignerCacheNilStats(t *testing.T) {
+	var cache *SignerCache
+
+	assert.Equal(t, CacheStats{}, cache.Stats())
+}
+
+func TestFileKeyStoreCache(t *testing.T) {
+	// setup
+	cache := NewSignerCache(8)
+	store, err := NewFileKeyStore(t.TempDir(), crypto.NewFactory(), newKeyring(t, newKeyEncryptionKey(t, "kek-1")), cache)
+	assert.NoError(t, err)
+	handle, err := store.Generate(domain.AlgorithmTypeRSA, domain.AlgorithmOptions{})
+	assert.NoError(t, err)
+
+	// execute
+	for i := 0; i < 3; i++ {
+		_, err = store.Sign(handle, []byte("data"))
+		assert.NoError(t, err)
+	}
+
+	// asserts: the key is only decoded by the first signature
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Hits)
+
+	// destroying the key evicts it, it can't be used from the cache anymore
+	assert.NoError(t, store.Destroy(handle))
+	assert.Equal(t, 0, cache.Stats().Size)
+	_, err = store.Sign(handle, []byte("data"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
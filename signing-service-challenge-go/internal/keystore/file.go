@@ -0,0 +1,291 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+// keyFile is the on-disk representation of a key pair, one file per handle.
+type keyFile struct {
+	Algorithm          domain.AlgorithmType `json:"algorithm"`
+	Curve              domain.CurveType     `json:"curve,omitempty"`
+	KeySize            int                  `json:"key_size,omitempty"`
+	Padding            domain.PaddingType   `json:"padding,omitempty"`
+	PublicKey          []byte               `json:"public_key"`
+	PrivateKey         []byte               `json:"private_key"`
+	KeyEncryptionKeyID string               `json:"key_encryption_key_id,omitempty"`
+}
+
+func (f *keyFile) options() domain.AlgorithmOptions {
+	return domain.AlgorithmOptions{
+		Curve:   f.Curve,
+		KeySize: f.KeySize,
+		Padding: f.Padding,
+	}
+}
+
+// FileKeyStore writes every key pair to its own file in a directory. When a keyring is given,
+// the private keys are encrypted with its active KEK and the KEK id is stored next to the ciphertext.
+type FileKeyStore struct {
+	directory string
+	factory   CryptoFactory
+	keyring   *crypto.Keyring
+	cache     *SignerCache
+	// cacheMu keeps a key being destroyed from being cached again by a signing that read it just before
+	cacheMu sync.RWMutex
+}
+
+// NewFileKeyStore creates the directory when needed. keyring may be nil, private keys are then written in plain PEM.
+// cache may be nil too, every signature then reads, unwraps and decodes the private key again.
+func NewFileKeyStore(directory string, factory CryptoFactory, keyring *crypto.Keyring, cache *SignerCache) (*FileKeyStore, error) {
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileKeyStore{
+		directory: directory,
+		factory:   factory,
+		keyring:   keyring,
+		cache:     cache,
+	}, nil
+}
+
+func (k *FileKeyStore) Generate(algorithm domain.AlgorithmType, options domain.AlgorithmOptions) (string, error) {
+	keyPair, err := k.factory.GenerateAlgorithm(algorithm, options)
+	if err != nil {
+		return "", err
+	}
+	marshaller, err := k.factory.CreateMarshaller(algorithm, options)
+	if err != nil {
+		return "", err
+	}
+	publicKey, privateKey, err := marshaller.Encode(keyPair)
+	if err != nil {
+		return "", err
+	}
+
+	handle := uuid.New().String()
+	file := &keyFile{
+		Algorithm: algorithm,
+		Curve:     options.Curve,
+		KeySize:   options.KeySize,
+		Padding:   options.Padding,
+		PublicKey: publicKey,
+	}
+	if err = k.wrap(handle, file, privateKey); err != nil {
+		return "", err
+	}
+	if err = k.write(handle, file); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+func (k *FileKeyStore) Sign(handle string, data []byte) ([]byte, error) {
+	signer, err := k.signer(handle)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(data)
+}
+
+// signer returns the decoded private key of handle, from the cache when it holds it.
+func (k *FileKeyStore) signer(handle string) (crypto.Signer, error) {
+	if k.cache != nil {
+		if signer, cached := k.cache.Get(handle); cached {
+			return signer, nil
+		}
+	}
+
+	k.cacheMu.RLock()
+	defer k.cacheMu.RUnlock()
+	file, err := k.read(handle)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := k.unwrap(handle, file)
+	if err != nil {
+		return nil, err
+	}
+	marshaller, err := k.factory.CreateMarshaller(file.Algorithm, file.options())
+	if err != nil {
+		return nil, err
+	}
+	signer, err := marshaller.Decode(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.cache != nil {
+		k.cache.Add(handle, signer)
+	}
+	return signer, nil
+}
+
+func (k *FileKeyStore) PublicKey(handle string) (crypto.Verifier, error) {
+	file, err := k.read(handle)
+	if err != nil {
+		return nil, err
+	}
+	marshaller, err := k.factory.CreateMarshaller(file.Algorithm, file.options())
+	if err != nil {
+		return nil, err
+	}
+	return marshaller.DecodePublic(file.PublicKey)
+}
+
+func (k *FileKeyStore) Destroy(handle string) error {
+	path, err := k.path(handle)
+	if err != nil {
+		return err
+	}
+	k.cacheMu.Lock()
+	defer k.cacheMu.Unlock()
+	if k.cache != nil {
+		k.cache.Evict(handle)
+	}
+	if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// Evict drops the decoded key of handle from the cache, e.g. because its device stopped signing.
+// The key is read from its file again when it is needed.
+func (k *FileKeyStore) Evict(handle string) {
+	if k.cache != nil {
+		k.cache.Evict(handle)
+	}
+}
+
+// Rewrap re-encrypts every private key that is not wrapped with the active KEK yet, plain keys included.
+// It returns how many keys were updated, so retired KEKs can be removed once it reports zero.
+func (k *FileKeyStore) Rewrap() (int, error) {
+	if k.keyring == nil {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(k.directory)
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, entry := range entries {
+		handle, isKeyFile := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !isKeyFile {
+			continue
+		}
+		file, err := k.read(handle)
+		if err != nil {
+			return rewrapped, err
+		}
+		if file.KeyEncryptionKeyID == k.keyring.ActiveID() {
+			continue
+		}
+		privateKey, err := k.unwrap(handle, file)
+		if err != nil {
+			return rewrapped, err
+		}
+		if err = k.wrap(handle, file, privateKey); err != nil {
+			return rewrapped, err
+		}
+		if err = k.write(handle, file); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// wrap stores privateKey in file, encrypted with the active KEK when a keyring is configured.
+// The handle is used as associated data, so a wrapped key copied to another file can't be unwrapped.
+func (k *FileKeyStore) wrap(handle string, file *keyFile, privateKey []byte) error {
+	if k.keyring == nil {
+		file.PrivateKey = privateKey
+		file.KeyEncryptionKeyID = ""
+		return nil
+	}
+	wrapped, keyEncryptionKeyID, err := k.keyring.Wrap(privateKey, []byte(handle))
+	if err != nil {
+		return err
+	}
+	file.PrivateKey = wrapped
+	file.KeyEncryptionKeyID = keyEncryptionKeyID
+	return nil
+}
+
+func (k *FileKeyStore) unwrap(handle string, file *keyFile) ([]byte, error) {
+	if file.KeyEncryptionKeyID == "" {
+		return file.PrivateKey, nil
+	}
+	if k.keyring == nil {
+		return nil, errors.New("private key is encrypted but no key encryption key is configured")
+	}
+	return k.keyring.Unwrap(file.PrivateKey, file.KeyEncryptionKeyID, []byte(handle))
+}
+
+func (k *FileKeyStore) read(handle string) (*keyFile, error) {
+	path, err := k.path(handle)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyFile
+	if err = json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// write replaces the key file atomically, so a crash never leaves a half written key behind.
+func (k *FileKeyStore) write(handle string, file *keyFile) error {
+	path, err := k.path(handle)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(k.directory, handle+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path only accepts UUID handles, so a handle can never point outside of the directory.
+func (k *FileKeyStore) path(handle string) (string, error) {
+	if parsed, err := uuid.Parse(handle); err != nil || parsed.String() != handle {
+		return "", ErrKeyNotFound
+	}
+	return filepath.Join(k.directory, handle+".json"), nil
+}
@@ -0,0 +1,30 @@
+package keystore
+
+import (
+	"errors"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+// ErrKeyNotFound is returned when no key exists for a handle.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyStore owns the private keys of the devices. Callers only get an opaque handle back,
+// so the key material never leaves the store and can be moved to an HSM or a cloud KMS later.
+type KeyStore interface {
+	// Generate creates a new key pair for the algorithm and returns its handle.
+	Generate(algorithm domain.AlgorithmType, options domain.AlgorithmOptions) (string, error)
+	// Sign signs data with the private key behind handle.
+	Sign(handle string, data []byte) ([]byte, error)
+	// PublicKey returns the public part of the key behind handle.
+	PublicKey(handle string) (crypto.Verifier, error)
+	// Destroy removes the key behind handle, signing with it is no longer possible afterwards.
+	Destroy(handle string) error
+}
+
+// CryptoFactory is the part of crypto.Factory the software based key stores need.
+type CryptoFactory interface {
+	CreateMarshaller(input domain.AlgorithmType, options domain.AlgorithmOptions) (crypto.AlgorithmMarshaller, error)
+	GenerateAlgorithm(input domain.AlgorithmType, options domain.AlgorithmOptions) (crypto.Signer, error)
+}
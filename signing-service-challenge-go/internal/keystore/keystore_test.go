@@ -0,0 +1,130 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+func TestKeyStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) KeyStore{
+		"software": func(t *testing.T) KeyStore {
+			return NewSoftwareKeyStore(crypto.NewFactory())
+		},
+		"file": func(t *testing.T) KeyStore {
+			store, err := NewFileKeyStore(t.TempDir(), crypto.NewFactory(), newKeyring(t, newKeyEncryptionKey(t, "kek-1")), NewSignerCache(8))
+			assert.NoError(t, err)
+			return store
+		},
+	}
+	algorithms := []struct {
+		tp      domain.AlgorithmType
+		options domain.AlgorithmOptions
+	}{
+		{tp: domain.AlgorithmTypeECC, options: domain.AlgorithmOptions{Curve: domain.CurveTypeP256}},
+		{tp: domain.AlgorithmTypeRSA, options: domain.AlgorithmOptions{Padding: domain.PaddingTypePKCS1v15}},
+		{tp: domain.AlgorithmTypeEd25519},
+	}
+
+	for name, newStore := range stores {
+		for _, algorithm := range algorithms {
+			t.Run(name+" "+string(algorithm.tp), func(t *testing.T) {
+				store := newStore(t)
+
+				// generate, sign and verify by handle
+				handle, err := store.Generate(algorithm.tp, algorithm.options)
+				assert.NoError(t, err)
+				signature, err := store.Sign(handle, []byte("data"))
+				assert.NoError(t, err)
+				verifier, err := store.PublicKey(handle)
+				assert.NoError(t, err)
+				assert.NoError(t, verifier.VerifySignature([]byte("data"), signature))
+
+				// destroyed keys are gone
+				assert.NoError(t, store.Destroy(handle))
+				_, err = store.Sign(handle, []byte("data"))
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+				assert.ErrorIs(t, store.Destroy(handle), ErrKeyNotFound)
+			})
+		}
+	}
+}
+
+func TestFileKeyStoreEncryption(t *testing.T) {
+	// prepare
+	directory := t.TempDir()
+	oldKek := newKeyEncryptionKey(t, "kek-1")
+	newKek := newKeyEncryptionKey(t, "kek-2")
+	plainStore, err := NewFileKeyStore(directory, crypto.NewFactory(), nil, nil)
+	assert.NoError(t, err)
+	plainHandle, err := plainStore.Generate(domain.AlgorithmTypeEd25519, domain.AlgorithmOptions{})
+	assert.NoError(t, err)
+	store, err := NewFileKeyStore(directory, crypto.NewFactory(), newKeyring(t, oldKek), nil)
+	assert.NoError(t, err)
+	handle, err := store.Generate(domain.AlgorithmTypeECC, domain.AlgorithmOptions{})
+	assert.NoError(t, err)
+
+	// the file never contains the plain PEM key
+	file, err := store.read(handle)
+	assert.NoError(t, err)
+	assert.Equal(t, "kek-1", file.KeyEncryptionKeyID)
+	assert.False(t, bytes.Contains(file.PrivateKey, []byte("PRIVATE_KEY")))
+
+	// a wrapped key copied to another handle can't be unwrapped
+	other, err := store.Generate(domain.AlgorithmTypeECC, domain.AlgorithmOptions{})
+	assert.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(directory, handle+".json"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(directory, other+".json"), content, 0o600))
+	_, err = store.Sign(other, []byte("data"))
+	assert.Error(t, err)
+	assert.NoError(t, store.Destroy(other))
+
+	// rotate: kek-2 becomes active, kek-1 is only kept for unwrapping
+	rotated, err := NewFileKeyStore(directory, crypto.NewFactory(), newKeyring(t, newKek, oldKek), nil)
+	assert.NoError(t, err)
+	rewrapped, err := rotated.Rewrap()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rewrapped)
+
+	// once re-wrapped, the retired KEK is not needed anymore
+	withoutOld, err := NewFileKeyStore(directory, crypto.NewFactory(), newKeyring(t, newKek), nil)
+	assert.NoError(t, err)
+	for _, h := range []string{handle, plainHandle} {
+		file, err = withoutOld.read(h)
+		assert.NoError(t, err)
+		assert.Equal(t, "kek-2", file.KeyEncryptionKeyID)
+		_, err = withoutOld.Sign(h, []byte("data"))
+		assert.NoError(t, err)
+	}
+	rewrapped, err = withoutOld.Rewrap()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rewrapped)
+
+	// handles can't escape the directory
+	_, err = withoutOld.Sign("../"+handle, []byte("data"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func newKeyEncryptionKey(t *testing.T, id string) crypto.KeyEncryptionKey {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return crypto.KeyEncryptionKey{ID: id, Key: key}
+}
+
+func newKeyring(t *testing.T, keys ...crypto.KeyEncryptionKey) *crypto.Keyring {
+	keyring, err := crypto.NewKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
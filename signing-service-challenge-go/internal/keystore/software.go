@@ -0,0 +1,79 @@
+package keystore
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+// SoftwareKeyStore keeps the generated key pairs in process memory, they are lost on restart.
+type SoftwareKeyStore struct {
+	factory CryptoFactory
+
+	mu   sync.RWMutex
+	keys map[string]crypto.Signer
+}
+
+func NewSoftwareKeyStore(factory CryptoFactory) *SoftwareKeyStore {
+	return &SoftwareKeyStore{
+		factory: factory,
+		keys:    map[string]crypto.Signer{},
+	}
+}
+
+func (k *SoftwareKeyStore) Generate(algorithm domain.AlgorithmType, options domain.AlgorithmOptions) (string, error) {
+	keyPair, err := k.factory.GenerateAlgorithm(algorithm, options)
+	if err != nil {
+		return "", err
+	}
+
+	handle := uuid.New().String()
+	k.mu.Lock()
+	k.keys[handle] = keyPair
+	k.mu.Unlock()
+	return handle, nil
+}
+
+func (k *SoftwareKeyStore) Sign(handle string, data []byte) ([]byte, error) {
+	keyPair, err := k.find(handle)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair.Sign(data)
+}
+
+func (k *SoftwareKeyStore) PublicKey(handle string) (crypto.Verifier, error) {
+	keyPair, err := k.find(handle)
+	if err != nil {
+		return nil, err
+	}
+	verifier, ok := keyPair.(crypto.Verifier)
+	if !ok {
+		return nil, errors.New("key does not support verification")
+	}
+	return verifier, nil
+}
+
+func (k *SoftwareKeyStore) Destroy(handle string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[handle]; !exists {
+		return ErrKeyNotFound
+	}
+	delete(k.keys, handle)
+	return nil
+}
+
+func (k *SoftwareKeyStore) find(handle string) (crypto.Signer, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keyPair, exists := k.keys[handle]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	return keyPair, nil
+}
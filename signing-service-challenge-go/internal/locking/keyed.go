@@ -0,0 +1,54 @@
+// Package locking provides locks that are taken per key, so work on unrelated keys never waits on a shared lock.
+package locking
+
+import (
+	"sync"
+)
+
+// KeyedMutex is a mutual exclusion lock per key, e.g. per device. Locks only exist while they are held or
+// waited for, so the number of keys over the lifetime of the process doesn't matter.
+// The zero value is ready to use.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu sync.Mutex
+	// refs counts the holder and the waiters, the lock is dropped from the map when it gets back to 0
+	refs int
+}
+
+// Lock locks key, waiting while another caller holds it.
+func (k *KeyedMutex) Lock(key string) {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedLock{}
+	}
+	lock, exists := k.locks[key]
+	if !exists {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.mu.Lock()
+}
+
+// Unlock unlocks key. Like sync.Mutex, unlocking a key that is not locked is a run-time error.
+func (k *KeyedMutex) Unlock(key string) {
+	k.mu.Lock()
+	lock, exists := k.locks[key]
+	if !exists {
+		k.mu.Unlock()
+		panic("locking: unlock of unlocked key " + key)
+	}
+	lock.refs--
+	if lock.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mu.Unlock()
+
+	lock.mu.Unlock()
+}
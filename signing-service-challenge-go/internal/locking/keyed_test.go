@@ -0,0 +1,67 @@
+package locking
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedMutexExcludesSameKey(t *testing.T) {
+	var locks KeyedMutex
+	var wg sync.WaitGroup
+	counters := map[string]int{}
+	var countersMu sync.Mutex
+
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			key := strconv.Itoa(worker % 2)
+			for i := 0; i < 1000; i++ {
+				locks.Lock(key)
+				// read and write in two steps, lost updates show up when two holders overlap
+				countersMu.Lock()
+				value := counters[key]
+				countersMu.Unlock()
+				countersMu.Lock()
+				counters[key] = value + 1
+				countersMu.Unlock()
+				locks.Unlock(key)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 4000, counters["0"])
+	assert.Equal(t, 4000, counters["1"])
+	assert.Empty(t, locks.locks, "released locks are dropped")
+}
+
+func TestKeyedMutexDoesNotBlockOtherKeys(t *testing.T) {
+	var locks KeyedMutex
+	locks.Lock("device-1")
+	defer locks.Unlock("device-1")
+
+	done := make(chan struct{})
+	go func() {
+		locks.Lock("device-2")
+		locks.Unlock("device-2")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("device-2 waited for the lock of device-1")
+	}
+}
+
+func TestKeyedMutexUnlockOfUnlockedKey(t *testing.T) {
+	var locks KeyedMutex
+	assert.Panics(t, func() {
+		locks.Unlock("device-1")
+	})
+}
@@ -1,145 +1,441 @@
 package persistence
 
 import (
-	"github.com/google/uuid"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/locking"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
 )
 
 type InMemoryStorage struct {
-	devicesMu   sync.Mutex
-	devicesData map[string]*domain.Device
+	// devicesMu only guards the map, the state of a device is guarded by its own entry,
+	// so requests for unrelated devices never wait for each other
+	devicesMu sync.RWMutex
+	devices   map[string]*deviceEntry
 
-	signingMu    sync.Mutex
-	signingsData map[string]*[]*domain.Signings
+	// signLocks serialise the signings of a device while the signature is computed, without blocking its readers
+	signLocks locking.KeyedMutex
+
+	// signingIDs indexes the signings by id, it is only written after the signing was appended to its device
+	signingIDsMu sync.RWMutex
+	signingIDs   map[string]signingRef
+}
+
+// signingRef locates a signing: the device it belongs to and its counter.
+type signingRef struct {
+	deviceId string
+	counter  int64
+}
+
+type deviceEntry struct {
+	mu       sync.RWMutex
+	device   domain.Device
+	signings []*domain.Signings
+	// signers holds every key of the device by version, the last one is active
+	signers []*domain.DeviceSigner
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		devicesMu:    sync.Mutex{},
-		signingMu:    sync.Mutex{},
-		devicesData:  map[string]*domain.Device{},
-		signingsData: map[string]*[]*domain.Signings{},
+		devices:    map[string]*deviceEntry{},
+		signingIDs: map[string]signingRef{},
 	}
 }
 
-func (in *InMemoryStorage) GetAll(pageNr int, pageSize int) ([]*domain.Device, int, error) {
-	startIndex := (pageNr - 1) * pageSize
-	if startIndex >= len(in.devicesData) {
-		return []*domain.Device{}, len(in.devicesData), nil
-	}
-	endIndex := startIndex + pageSize
-	if endIndex > len(in.devicesData) {
-		endIndex = len(in.devicesData)
+func (in *InMemoryStorage) entry(id string) (*deviceEntry, error) {
+	in.devicesMu.RLock()
+	entry, exists := in.devices[id]
+	in.devicesMu.RUnlock()
+	if !exists {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
 	}
+	return entry, nil
+}
 
-	counter := 0
-	result := make([]*domain.Device, pageSize)
-	i := 0
-	in.devicesMu.Lock()
-	for _, device := range in.devicesData {
-		if counter > endIndex {
-			break
-		}
+// snapshot copies the device, callers can keep it while the counter of the stored one advances.
+func (e *deviceEntry) snapshot() *domain.Device {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	device := e.device
+	return &device
+}
 
-		if counter >= startIndex && i < pageSize {
-			result[i] = device
-			i++
+// signingsView returns the signings appended so far, appends never touch the returned elements.
+func (e *deviceEntry) signingsView() []*domain.Signings {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.signings[:len(e.signings):len(e.signings)]
+}
+
+// sortedDevices snapshots the devices passing the filter in its sort order, map iteration order is random.
+func (in *InMemoryStorage) sortedDevices(filter domain.DeviceFilter) []*domain.Device {
+	in.devicesMu.RLock()
+	devices := make([]*domain.Device, 0, len(in.devices))
+	for _, entry := range in.devices {
+		if device := entry.snapshot(); matchesDevice(device, filter) {
+			devices = append(devices, device)
 		}
-		counter++
 	}
-	in.devicesMu.Unlock()
-	return result, len(in.devicesData), nil
+	in.devicesMu.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool {
+		return deviceLess(devices[i], devices[j], filter)
+	})
+	return devices
+}
+
+func (in *InMemoryStorage) GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error) {
+	devices := in.sortedDevices(filter)
+	return offsetPage(devices, pageNr, pageSize), len(devices), nil
+}
+
+func (in *InMemoryStorage) GetDevicesPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error) {
+	filter.Sort, filter.Descending = domain.DeviceSortCreatedAt, false
+	devices, more := cursorPage(in.sortedDevices(filter), cursor, pageSize, compareDevice)
+	return devices, more, nil
 }
 
 func (in *InMemoryStorage) GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error) {
-	in.signingMu.Lock()
-	creationsList, exist := in.signingsData[deviceId]
-	in.signingMu.Unlock()
-	if !exist || creationsList == nil || len(*creationsList) == 0 {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, 0, err
+	}
+	creations := entry.signingsView()
+	if len(creations) == 0 {
 		return nil, 0, nil
 	}
-	creations := *creationsList
+	return offsetPage(creations, pageNr, pageSize), len(creations), nil
+}
 
-	startIndex := (pageNr - 1) * pageSize
-	if startIndex >= len(creations) {
-		return []*domain.Signings{}, len(creations), services.NewDBError("invalid page number")
-	}
-	endIndex := startIndex + pageSize
-	if endIndex > len(creations) {
-		endIndex = len(creations)
+func (in *InMemoryStorage) GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) ([]*domain.Signings, bool, error) {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, false, err
 	}
+	// entries are appended in counter order
+	signings, more := cursorPage(entry.signingsView(), cursor, pageSize, compareSigning)
+	return signings, more, nil
+}
 
-	counter := 0
-	result := make([]*domain.Signings, pageSize)
-	for _, data := range creations[startIndex:endIndex] {
-		result[counter] = data
-		counter++
+func (in *InMemoryStorage) GetSigningChain(deviceId string) ([]*domain.Signings, error) {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, len(creations), nil
+	// entries are appended in counter order, a copy is enough to keep the caller away from concurrent appends
+	creations := entry.signingsView()
+	result := make([]*domain.Signings, len(creations))
+	copy(result, creations)
+	return result, nil
 }
 
 func (in *InMemoryStorage) Save(device domain.Device) error {
 	in.devicesMu.Lock()
 	defer in.devicesMu.Unlock()
-	if _, exists := in.devicesData[device.ID]; exists {
-		return services.NewDBError("invalid id for the device")
+	if _, exists := in.devices[device.ID]; exists {
+		return domain.ErrDeviceExists
 	}
-	var signingCreations []*domain.Signings
-	in.devicesData[device.ID] = &device
-	in.signingsData[device.ID] = &signingCreations
+	device = storedDevice(device)
+	in.devices[device.ID] = &deviceEntry{device: device, signers: []*domain.DeviceSigner{initialSigner(device)}}
 	return nil
 }
 
 func (in *InMemoryStorage) FindByID(id string) (*domain.Device, error) {
-	in.devicesMu.Lock()
-	current, exists := in.devicesData[id]
-	in.devicesMu.Unlock()
-	if !exists {
-		return nil, services.NewDBError("invalid id for the device")
+	entry, err := in.entry(id)
+	if err != nil {
+		return nil, err
 	}
-	return current, nil
+	return entry.snapshot(), nil
 }
 
-func (in *InMemoryStorage) GetDeviceCounterAndLastEncoded(id string) (int64, string, error) {
-	in.signingMu.Lock()
-	current, exists := in.signingsData[id]
-	in.signingMu.Unlock()
-	if !exists {
-		return 0, "", services.NewDBError("invalid id for the device")
+func (in *InMemoryStorage) UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error {
+	return in.updateDeviceStateWith(id, from, to, clock, in.applyDeviceState)
+}
+
+// updateDeviceStateWith checks the transition and reads the clock under the sign lock of the device, so it waits for a
+// signing in progress, and hands it to store like appendSigningWith does.
+func (in *InMemoryStorage) updateDeviceStateWith(id string, from, to domain.DeviceState, clock services.Clock, store func(id string, state domain.DeviceState, changedAt time.Time) error) error {
+	entry, err := in.entry(id)
+	if err != nil {
+		return err
+	}
+	in.signLocks.Lock(id)
+	defer in.signLocks.Unlock(id)
+
+	if entry.snapshot().State != from {
+		return services.NewConflictError(services.CodeDeviceModified, "device state was changed concurrently, please retry")
+	}
+	return store(id, to, clock())
+}
+
+func (in *InMemoryStorage) applyDeviceState(id string, state domain.DeviceState, changedAt time.Time) error {
+	entry, err := in.entry(id)
+	if err != nil {
+		return err
+	}
+	entry.mu.Lock()
+	entry.device.State = state
+	entry.device.StateChangedAt = changedAt
+	entry.mu.Unlock()
+	return nil
+}
+
+func (in *InMemoryStorage) UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error {
+	return in.updateDeviceDetailsWith(id, version, label, metadata, in.applyDeviceDetails)
+}
+
+// updateDeviceDetailsWith checks the version under the sign lock of the device, which every write of a device takes,
+// and hands the update to store like updateDeviceStateWith does.
+func (in *InMemoryStorage) updateDeviceDetailsWith(id string, version int64, label *string, metadata map[string]string, store func(id string, label *string, metadata map[string]string) error) error {
+	entry, err := in.entry(id)
+	if err != nil {
+		return err
+	}
+	in.signLocks.Lock(id)
+	defer in.signLocks.Unlock(id)
+
+	if entry.snapshot().Version != version {
+		return services.NewPreconditionFailedError(services.CodeDeviceModified, "device was modified concurrently, fetch it and retry")
+	}
+	return store(id, label, metadata)
+}
+
+func (in *InMemoryStorage) applyDeviceDetails(id string, label *string, metadata map[string]string) error {
+	entry, err := in.entry(id)
+	if err != nil {
+		return err
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	entry.mu.Lock()
+	entry.device.Label = label
+	entry.device.Metadata = metadata
+	entry.device.Version++
+	entry.mu.Unlock()
+	return nil
+}
+
+func (in *InMemoryStorage) RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error) {
+	return in.rotateDeviceKeyWith(deviceId, signer, in.addSigner)
+}
+
+// rotateDeviceKeyWith checks the state and numbers the signer under the sign lock of the device, so no signing picks the
+// active key while it changes and a device being decommissioned gets no new key, and hands it to store like
+// appendSigningWith does.
+func (in *InMemoryStorage) rotateDeviceKeyWith(deviceId string, signer domain.DeviceSigner, store func(id string, signer *domain.DeviceSigner) error) (*domain.DeviceSigner, error) {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	in.signLocks.Lock(deviceId)
+	defer in.signLocks.Unlock(deviceId)
+
+	if entry.snapshot().State == domain.DeviceStateDecommissioned {
+		return nil, services.NewConflictError(services.CodeDeviceDecommissioned, "a decommissioned device can't get new keys")
 	}
-	if current == nil || len(*current) == 0 {
+	signers := entry.signersView()
+	signer.DeviceId = deviceId
+	signer.Version = signers[len(signers)-1].Version + 1
+	if err = store(deviceId, &signer); err != nil {
+		return nil, err
+	}
+	return &signer, nil
+}
+
+// addSigner stores a signer that follows the last one of the device and makes it the active key.
+func (in *InMemoryStorage) addSigner(id string, signer *domain.DeviceSigner) error {
+	entry, err := in.entry(id)
+	if err != nil {
+		return err
+	}
+	entry.mu.Lock()
+	entry.signers = append(entry.signers, signer)
+	entry.device.KeyID = signer.ID
+	entry.device.KeyCreatedAt = signer.CreatedAt
+	entry.device.KeyHandle = signer.KeyHandle
+	entry.mu.Unlock()
+	return nil
+}
+
+func (in *InMemoryStorage) GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error) {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	signers := entry.signersView()
+	result := make([]*domain.DeviceSigner, len(signers))
+	for i, signer := range signers {
+		copied := *signer
+		result[i] = &copied
+	}
+	return result, nil
+}
+
+// signersView returns the signers added so far, like signingsView.
+func (e *deviceEntry) signersView() []*domain.DeviceSigner {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.signers[:len(e.signers):len(e.signers)]
+}
+
+func (in *InMemoryStorage) AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error) {
+	return in.appendSigningWith(deviceId, details, sign, in.appendSigning)
+}
+
+// appendSigningWith runs sign under the sign lock of the device and hands the result to store,
+// which lets the journaled storage write the signing to its journal first.
+func (in *InMemoryStorage) appendSigningWith(deviceId string, details domain.SigningDetails, sign domain.SignFunc, store func(id string, signing *domain.Signings) error) (*domain.Signings, error) {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	in.signLocks.Lock(deviceId)
+	defer in.signLocks.Unlock(deviceId)
+
+	device := entry.snapshot()
+	if device.State != domain.DeviceStateActive {
+		return nil, &domain.DeviceNotActiveError{State: device.State}
+	}
+
+	counter, lastSignature, err := in.lastSigning(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	signature, signedData, err := sign(counter+1, lastSignature, device.KeyHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	signing := newSigning(device, counter+1, signature, signedData, details)
+	if err = store(deviceId, signing); err != nil {
+		return nil, err
+	}
+	return signing, nil
+}
+
+// lastSigning returns the counter and the signature of the last signing of the device, 0 and "" when there is none.
+func (in *InMemoryStorage) lastSigning(id string) (int64, string, error) {
+	entry, err := in.entry(id)
+	if err != nil {
+		return 0, "", err
+	}
+	signings := entry.signingsView()
+	if len(signings) == 0 {
 		return 0, "", nil
 	}
-	lastData := (*current)[len(*current)-1]
+	lastData := signings[len(signings)-1]
 	return lastData.Counter, lastData.Signature, nil
 }
 
-func (in *InMemoryStorage) SaveDeviceCounterAndLastEncoded(id string, counter int64, currentSignature, signedData string) error {
-	in.devicesMu.Lock()
-	currentDevice, exists := in.devicesData[id]
-	in.devicesMu.Unlock()
+// GetSigningByCounter returns the signing of the device with the given counter.
+func (in *InMemoryStorage) GetSigningByCounter(deviceId string, counter int64) (*domain.Signings, error) {
+	entry, err := in.entry(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	// counters are gapless and start at 1, the signing with counter n is the n-th one
+	signings := entry.signingsView()
+	if counter < 1 || counter > int64(len(signings)) {
+		return nil, services.NewNotFoundError(services.CodeSigningNotFound, "signing not found")
+	}
+	return signings[counter-1], nil
+}
+
+// GetSigningByID returns the signing with the given id, whichever device it belongs to.
+func (in *InMemoryStorage) GetSigningByID(id string) (*domain.Signings, error) {
+	in.signingIDsMu.RLock()
+	ref, exists := in.signingIDs[id]
+	in.signingIDsMu.RUnlock()
 	if !exists {
-		return services.NewDBError("invalid id for the device")
+		return nil, services.NewNotFoundError(services.CodeSigningNotFound, "signing not found")
 	}
-	currentDevice.Counter = counter
+	return in.GetSigningByCounter(ref.deviceId, ref.counter)
+}
 
-	in.signingMu.Lock()
-	list := in.signingsData[id]
-	in.signingMu.Unlock()
-	currentData := *list
+// indexSigning makes the signing reachable by its id.
+func (in *InMemoryStorage) indexSigning(deviceId string, signing *domain.Signings) {
+	in.signingIDsMu.Lock()
+	in.signingIDs[signing.ID] = signingRef{deviceId: deviceId, counter: signing.Counter}
+	in.signingIDsMu.Unlock()
+}
 
-	currentData = append(currentData, &domain.Signings{
-		ID:         uuid.New().String(),
-		Counter:    counter,
-		Signature:  currentSignature,
-		SignedData: signedData,
-	})
-	in.signingMu.Lock()
-	in.signingsData[id] = &currentData
-	in.signingMu.Unlock()
+// appendSigning stores a signing that follows the last one of the device.
+func (in *InMemoryStorage) appendSigning(id string, signing *domain.Signings) error {
+	entry, err := in.entry(id)
+	if err != nil {
+		return err
+	}
+	entry.mu.Lock()
+	entry.signings = append(entry.signings, signing)
+	entry.device.Counter = signing.Counter
+	entry.mu.Unlock()
+	in.indexSigning(id, signing)
+	return nil
+}
+
+// deviceState is a device together with its signings and keys, as written to and read from snapshots.
+type deviceState struct {
+	Device   domain.Device
+	Signings []*domain.Signings
+	Signers  []*domain.DeviceSigner `json:",omitempty"`
+}
+
+// states copies every device and its signings, the callers must keep writes away while it runs.
+func (in *InMemoryStorage) states() []deviceState {
+	in.devicesMu.RLock()
+	defer in.devicesMu.RUnlock()
+
+	result := make([]deviceState, 0, len(in.devices))
+	for _, entry := range in.devices {
+		entry.mu.RLock()
+		result = append(result, deviceState{
+			Device:   entry.device,
+			Signings: append([]*domain.Signings{}, entry.signings...),
+			Signers:  append([]*domain.DeviceSigner{}, entry.signers...),
+		})
+		entry.mu.RUnlock()
+	}
+	return result
+}
+
+// restore puts back a device, its signings and its keys taken by states. States taken before keys could be rotated
+// have no signers, the device keeps the key it was stored with.
+func (in *InMemoryStorage) restore(state deviceState) error {
+	if err := in.Save(state.Device); err != nil {
+		return err
+	}
+	entry, err := in.entry(state.Device.ID)
+	if err != nil {
+		return err
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if len(state.Signers) > 0 {
+		entry.signers = append([]*domain.DeviceSigner{}, state.Signers...)
+	}
+	entry.signings = make([]*domain.Signings, len(state.Signings))
+	for i, signing := range state.Signings {
+		entry.signings[i] = signedWith(signing, entry.device.KeyID)
+		in.indexSigning(state.Device.ID, signing)
+	}
+	if len(entry.signings) > 0 {
+		entry.device.Counter = entry.signings[len(entry.signings)-1].Counter
+	}
 	return nil
 }
+
+// signedWith returns the signing with keyID as its key when it has none, signings stored before keys could be rotated
+// were all signed with the first key of their device.
+func signedWith(signing *domain.Signings, keyID string) *domain.Signings {
+	if signing == nil || signing.KeyID != "" {
+		return signing
+	}
+	copied := *signing
+	copied.KeyID = keyID
+	return &copied
+}
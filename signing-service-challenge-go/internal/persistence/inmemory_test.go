@@ -52,7 +52,7 @@ func TestGetAll(t *testing.T) {
 				}
 			}
 
-			list, total, _ := store.GetAll(test.page, test.pageSize)
+			list, total, _ := store.GetAll(domain.DeviceFilter{}, test.page, test.pageSize)
 
 			if len(list) != test.expectedResultLength {
 				t.Errorf("Expected length %d, got %d", test.expectedResultLength, len(list))
@@ -64,3 +64,9 @@ func TestGetAll(t *testing.T) {
 		})
 	}
 }
+
+func TestInMemoryStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return NewInMemoryStorage()
+	})
+}
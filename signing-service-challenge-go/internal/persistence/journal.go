@@ -0,0 +1,557 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// SyncPolicy decides when the journal is flushed to stable storage.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs every record before the write is acknowledged, nothing acknowledged is lost on a crash.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs in the background, a crash loses at most the records of the last interval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+const (
+	journalFileName  = "journal.log"
+	snapshotFileName = "snapshot"
+
+	journalOpSaveDevice    = "save_device"
+	journalOpAppendSigning = "append_signing"
+	journalOpUpdateState   = "update_state"
+	journalOpRotateKey     = "rotate_key"
+	journalOpUpdateDetails = "update_details"
+
+	// frameHeaderSize is the length and the CRC-32C of the payload, both big endian uint32
+	frameHeaderSize = 8
+	maxFrameSize    = 256 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// JournalOptions configures the journal of a JournaledStorage.
+type JournalOptions struct {
+	// Dir holds the journal and the latest snapshot
+	Dir  string
+	Sync SyncPolicy
+	// SyncInterval is the flush period of SyncInterval
+	SyncInterval time.Duration
+	// CompactEvery is the number of records after which the store is compacted into a snapshot, 0 disables compaction
+	CompactEvery int
+}
+
+type journalRecord struct {
+	Seq      uint64
+	Op       string
+	Device   *domain.Device       `json:",omitempty"`
+	DeviceID string               `json:",omitempty"`
+	Signing  *domain.Signings     `json:",omitempty"`
+	Signer   *domain.DeviceSigner `json:",omitempty"`
+
+	FromVersion int64             `json:",omitempty"`
+	Label       *string           `json:",omitempty"`
+	Metadata    map[string]string `json:",omitempty"`
+
+	FromState domain.DeviceState `json:",omitempty"`
+	State     domain.DeviceState `json:",omitempty"`
+	ChangedAt *time.Time         `json:",omitempty"`
+}
+
+type journalSnapshot struct {
+	// Seq is the last record contained in the snapshot, older records left in the journal are skipped on replay
+	Seq     uint64
+	Devices []deviceState
+}
+
+// JournaledStorage is an InMemoryStorage whose writes are appended to a journal before they are applied.
+// On startup the store is rebuilt from the latest snapshot and the records written after it. Recovery stops with an
+// error on a truncated or corrupted journal instead of dropping the tail, as that would lose signature counters.
+type JournaledStorage struct {
+	*InMemoryStorage
+
+	options JournalOptions
+
+	// writeMu serialises the writes, so the journal order is the order in which they are applied
+	writeMu sync.Mutex
+	file    *os.File
+	seq     uint64
+	records int
+	// failed is set once a journal write fails, the journal may end with a partial record and no more writes are accepted
+	failed error
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewJournaledStorage replays the journal in options.Dir, creating it when missing, and opens it for appending.
+func NewJournaledStorage(options JournalOptions) (*JournaledStorage, error) {
+	switch options.Sync {
+	case "":
+		options.Sync = SyncAlways
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if options.SyncInterval <= 0 {
+			return nil, errors.New("the interval sync policy needs a positive sync interval")
+		}
+	default:
+		return nil, fmt.Errorf("unknown journal sync policy %q", options.Sync)
+	}
+	if err := os.MkdirAll(options.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	storage := &JournaledStorage{
+		InMemoryStorage: NewInMemoryStorage(),
+		options:         options,
+	}
+	if err := storage.recover(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(storage.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	storage.file = file
+
+	if options.Sync == SyncInterval {
+		storage.stop = make(chan struct{})
+		storage.done = make(chan struct{})
+		go storage.syncLoop()
+	}
+	return storage, nil
+}
+
+// Close flushes and closes the journal, calling it again is a no-op.
+func (j *JournaledStorage) Close() error {
+	j.closeOnce.Do(func() {
+		if j.stop != nil {
+			close(j.stop)
+			<-j.done
+		}
+
+		j.writeMu.Lock()
+		defer j.writeMu.Unlock()
+		j.closeErr = j.file.Sync()
+		if err := j.file.Close(); err != nil {
+			j.closeErr = err
+		}
+		j.failed = errors.New("journal is closed")
+	})
+	return j.closeErr
+}
+
+func (j *JournaledStorage) Save(device domain.Device) error {
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+
+	if _, err := j.InMemoryStorage.FindByID(device.ID); err == nil {
+		return domain.ErrDeviceExists
+	}
+	device = storedDevice(device)
+	if err := j.append(journalRecord{Op: journalOpSaveDevice, Device: &device}); err != nil {
+		return err
+	}
+	if err := j.InMemoryStorage.Save(device); err != nil {
+		return err
+	}
+	j.compactIfNeeded()
+	return nil
+}
+
+// AppendSigning signs under the lock of the device only, the journal is locked just to write and apply the result.
+// Writing and applying happen together so a compaction can't snapshot a journaled signing before it is applied.
+func (j *JournaledStorage) AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error) {
+	return j.InMemoryStorage.appendSigningWith(deviceId, details, sign, func(id string, signing *domain.Signings) error {
+		j.writeMu.Lock()
+		defer j.writeMu.Unlock()
+
+		if err := j.append(journalRecord{Op: journalOpAppendSigning, DeviceID: id, Signing: signing}); err != nil {
+			return err
+		}
+		if err := j.InMemoryStorage.appendSigning(id, signing); err != nil {
+			return err
+		}
+		j.compactIfNeeded()
+		return nil
+	})
+}
+
+func (j *JournaledStorage) UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error {
+	return j.InMemoryStorage.updateDeviceStateWith(id, from, to, clock, func(id string, state domain.DeviceState, changedAt time.Time) error {
+		j.writeMu.Lock()
+		defer j.writeMu.Unlock()
+
+		record := journalRecord{Op: journalOpUpdateState, DeviceID: id, FromState: from, State: state, ChangedAt: &changedAt}
+		if err := j.append(record); err != nil {
+			return err
+		}
+		if err := j.InMemoryStorage.applyDeviceState(id, state, changedAt); err != nil {
+			return err
+		}
+		j.compactIfNeeded()
+		return nil
+	})
+}
+
+func (j *JournaledStorage) UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error {
+	return j.InMemoryStorage.updateDeviceDetailsWith(id, version, label, metadata, func(id string, label *string, metadata map[string]string) error {
+		j.writeMu.Lock()
+		defer j.writeMu.Unlock()
+
+		record := journalRecord{Op: journalOpUpdateDetails, DeviceID: id, FromVersion: version, Label: label, Metadata: metadata}
+		if err := j.append(record); err != nil {
+			return err
+		}
+		if err := j.InMemoryStorage.applyDeviceDetails(id, label, metadata); err != nil {
+			return err
+		}
+		j.compactIfNeeded()
+		return nil
+	})
+}
+
+func (j *JournaledStorage) RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error) {
+	return j.InMemoryStorage.rotateDeviceKeyWith(deviceId, signer, func(id string, signer *domain.DeviceSigner) error {
+		j.writeMu.Lock()
+		defer j.writeMu.Unlock()
+
+		if err := j.append(journalRecord{Op: journalOpRotateKey, DeviceID: id, Signer: signer}); err != nil {
+			return err
+		}
+		if err := j.InMemoryStorage.addSigner(id, signer); err != nil {
+			return err
+		}
+		j.compactIfNeeded()
+		return nil
+	})
+}
+
+// Compact writes a snapshot of the whole store and starts an empty journal. Writes wait until it is done.
+func (j *JournaledStorage) Compact() error {
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+	return j.compact()
+}
+
+func (j *JournaledStorage) journalPath() string {
+	return filepath.Join(j.options.Dir, journalFileName)
+}
+
+func (j *JournaledStorage) snapshotPath() string {
+	return filepath.Join(j.options.Dir, snapshotFileName)
+}
+
+// append writes the record to the journal, the caller holds writeMu.
+func (j *JournaledStorage) append(record journalRecord) error {
+	if j.failed != nil {
+		return fmt.Errorf("journal is unavailable: %w", j.failed)
+	}
+
+	record.Seq = j.seq + 1
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(encodeFrame(payload)); err == nil && j.options.Sync == SyncAlways {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		j.failed = err
+		return err
+	}
+
+	j.seq = record.Seq
+	j.records++
+	return nil
+}
+
+// compactIfNeeded runs after the write is durable, so a failed compaction is only logged and retried on the next write.
+func (j *JournaledStorage) compactIfNeeded() {
+	if j.options.CompactEvery <= 0 || j.records < j.options.CompactEvery {
+		return
+	}
+	if err := j.compact(); err != nil {
+		logrus.WithError(err).Error("failed to compact the journal")
+	}
+}
+
+// compact replaces the snapshot before the journal: a crash in between leaves records the new snapshot already
+// contains, which replay skips by their sequence number.
+func (j *JournaledStorage) compact() error {
+	if j.failed != nil {
+		return fmt.Errorf("journal is unavailable: %w", j.failed)
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(journalSnapshot{Seq: j.seq, Devices: j.InMemoryStorage.states()})
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomically(j.snapshotPath(), encodeFrame(payload)); err != nil {
+		return err
+	}
+	if err = writeFileAtomically(j.journalPath(), nil); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.journalPath(), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		j.failed = err
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	j.records = 0
+	return nil
+}
+
+func (j *JournaledStorage) syncLoop() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.writeMu.Lock()
+			if err := j.file.Sync(); err != nil && j.failed == nil {
+				j.failed = err
+			}
+			j.writeMu.Unlock()
+		}
+	}
+}
+
+// recover loads the snapshot and replays the journal written after it.
+func (j *JournaledStorage) recover() error {
+	snapshot, err := readSnapshot(j.snapshotPath())
+	if err != nil {
+		return err
+	}
+	for _, state := range snapshot.Devices {
+		if err = j.InMemoryStorage.restore(state); err != nil {
+			return fmt.Errorf("snapshot holds device %s twice", state.Device.ID)
+		}
+	}
+	j.seq = snapshot.Seq
+
+	file, err := os.Open(j.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("journal %s is corrupted at offset %d: %v", j.journalPath(), offset, err)
+		}
+
+		var record journalRecord
+		if err = json.Unmarshal(payload, &record); err != nil {
+			return fmt.Errorf("journal %s is corrupted at offset %d: %v", j.journalPath(), offset, err)
+		}
+		if err = j.replay(record, snapshot.Seq); err != nil {
+			return fmt.Errorf("journal %s can't be replayed at offset %d: %v", j.journalPath(), offset, err)
+		}
+		offset += int64(frameHeaderSize + len(payload))
+	}
+}
+
+// replay applies a journal record, records up to snapshotSeq are already part of the snapshot.
+func (j *JournaledStorage) replay(record journalRecord, snapshotSeq uint64) error {
+	if record.Seq <= snapshotSeq {
+		return nil
+	}
+	if record.Seq != j.seq+1 {
+		return fmt.Errorf("record %d follows record %d", record.Seq, j.seq)
+	}
+
+	switch record.Op {
+	case journalOpSaveDevice:
+		if record.Device == nil {
+			return fmt.Errorf("record %d has no device", record.Seq)
+		}
+		if err := j.InMemoryStorage.Save(*record.Device); err != nil {
+			return fmt.Errorf("record %d saves device %s twice", record.Seq, record.Device.ID)
+		}
+	case journalOpAppendSigning:
+		if record.Signing == nil {
+			return fmt.Errorf("record %d has no signing", record.Seq)
+		}
+		device, err := j.InMemoryStorage.FindByID(record.DeviceID)
+		if err != nil {
+			return fmt.Errorf("record %d signs with unknown device %s", record.Seq, record.DeviceID)
+		}
+		// checked against the signings rather than the device, which journals may have saved with a client's counter
+		last, _, err := j.InMemoryStorage.lastSigning(record.DeviceID)
+		if err != nil {
+			return err
+		}
+		if record.Signing.Counter != last+1 {
+			return fmt.Errorf("record %d stores counter %d after counter %d", record.Seq, record.Signing.Counter, last)
+		}
+		if err = j.InMemoryStorage.appendSigning(record.DeviceID, signedWith(record.Signing, device.KeyID)); err != nil {
+			return err
+		}
+	case journalOpUpdateState:
+		device, err := j.InMemoryStorage.FindByID(record.DeviceID)
+		if err != nil {
+			return fmt.Errorf("record %d changes the state of unknown device %s", record.Seq, record.DeviceID)
+		}
+		if device.State != record.FromState || record.ChangedAt == nil {
+			return fmt.Errorf("record %d moves device %s from %s while it is %s", record.Seq, record.DeviceID, record.FromState, device.State)
+		}
+		if err = j.InMemoryStorage.applyDeviceState(record.DeviceID, record.State, *record.ChangedAt); err != nil {
+			return err
+		}
+	case journalOpUpdateDetails:
+		device, err := j.InMemoryStorage.FindByID(record.DeviceID)
+		if err != nil {
+			return fmt.Errorf("record %d updates unknown device %s", record.Seq, record.DeviceID)
+		}
+		if device.Version != record.FromVersion {
+			return fmt.Errorf("record %d updates device %s from version %d while it is at %d", record.Seq, record.DeviceID, record.FromVersion, device.Version)
+		}
+		if err = j.InMemoryStorage.applyDeviceDetails(record.DeviceID, record.Label, record.Metadata); err != nil {
+			return err
+		}
+	case journalOpRotateKey:
+		if record.Signer == nil {
+			return fmt.Errorf("record %d has no signer", record.Seq)
+		}
+		signers, err := j.InMemoryStorage.GetDeviceSigners(record.DeviceID)
+		if err != nil {
+			return fmt.Errorf("record %d rotates the key of unknown device %s", record.Seq, record.DeviceID)
+		}
+		if last := signers[len(signers)-1].Version; record.Signer.Version != last+1 {
+			return fmt.Errorf("record %d stores key version %d after version %d", record.Seq, record.Signer.Version, last)
+		}
+		if err = j.InMemoryStorage.addSigner(record.DeviceID, record.Signer); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("record %d has unknown operation %q", record.Seq, record.Op)
+	}
+
+	j.seq = record.Seq
+	j.records++
+	return nil
+}
+
+func readSnapshot(path string) (*journalSnapshot, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &journalSnapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	payload, err := readFrame(bufio.NewReader(file))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s is corrupted: %v", path, err)
+	}
+	var snapshot journalSnapshot
+	if err = json.Unmarshal(payload, &snapshot); err != nil {
+		return nil, fmt.Errorf("snapshot %s is corrupted: %v", path, err)
+	}
+	return &snapshot, nil
+}
+
+func encodeFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	return append(frame, payload...)
+}
+
+// readFrame returns io.EOF only at a clean end of the input, a partial frame is io.ErrUnexpectedEOF.
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("record length %d is out of range", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// writeFileAtomically replaces path with content through a synced temporary file, so readers see either version.
+func writeFileAtomically(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,280 @@
+package persistence
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+func newJournaledTestStorage(t *testing.T, options JournalOptions) *JournaledStorage {
+	store, err := NewJournaledStorage(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+// fillJournal stores a device with the given number of signings.
+func fillJournal(t *testing.T, store Storage, signings int) {
+	assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC, KeyHandle: "handle-1"}))
+	for i := 0; i < signings; i++ {
+		appendTestSigning(t, store)
+	}
+}
+
+func appendTestSigning(t *testing.T, store Storage) {
+	_, err := store.AppendSigning("device-1", domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+		return "sig-" + strconv.FormatInt(counter, 10), "data", nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestJournaledStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return newJournaledTestStorage(t, JournalOptions{Dir: t.TempDir(), Sync: SyncNever})
+	})
+}
+
+func TestJournaledConcurrentCounter(t *testing.T) {
+	store := newJournaledTestStorage(t, JournalOptions{Dir: t.TempDir(), Sync: SyncNever})
+	testConcurrentCounter(t, []Storage{store, store})
+}
+
+func TestJournaledStorageRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		options JournalOptions
+	}{
+		{
+			name:    "sync always",
+			options: JournalOptions{Sync: SyncAlways},
+		},
+		{
+			name:    "sync interval",
+			options: JournalOptions{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond},
+		},
+		{
+			name:    "compaction in between",
+			options: JournalOptions{Sync: SyncAlways, CompactEvery: 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			test.options.Dir = t.TempDir()
+			store := newJournaledTestStorage(t, test.options)
+			fillJournal(t, store, 10)
+			before, err := store.GetSigningChain("device-1")
+			assert.NoError(t, err)
+			assert.NoError(t, store.Close())
+
+			// execute
+			recovered := newJournaledTestStorage(t, test.options)
+
+			// asserts
+			device, err := recovered.FindByID("device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(10), device.Counter)
+			after, err := recovered.GetSigningChain("device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, before, after)
+			found, err := recovered.GetSigningByID(before[0].ID)
+			assert.NoError(t, err, "journaled and snapshotted signings can be found by id")
+			assert.Equal(t, before[0], found)
+
+			// the recovered store keeps appending where it stopped
+			signing, err := recovered.AppendSigning("device-1", domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+				assert.Equal(t, "sig-10", lastSignature)
+				return "sig-11", "data", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(11), signing.Counter)
+		})
+	}
+}
+
+func TestJournaledStorageRecoversDeviceSavedWithCounter(t *testing.T) {
+	// setup: journals may hold a device saved with the counter a client sent
+	dir := t.TempDir()
+	store := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+	assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC, KeyHandle: "handle-1", Counter: 5}))
+	appendTestSigning(t, store)
+	appendTestSigning(t, store)
+	assert.NoError(t, store.Close())
+
+	// execute
+	recovered := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+
+	// asserts
+	chain, err := recovered.GetSigningChain("device-1")
+	assert.NoError(t, err)
+	assert.Len(t, chain, 2)
+	device, err := recovered.FindByID("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), device.Counter)
+}
+
+func TestJournaledStorageCrashDuringCompaction(t *testing.T) {
+	// setup: the snapshot was replaced but the crash happened before the journal was emptied
+	dir := t.TempDir()
+	store := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+	fillJournal(t, store, 5)
+	journal, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Compact())
+	appendTestSigning(t, store)
+	assert.NoError(t, store.Close())
+	current, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, journalFileName), append(journal, current...), 0o600))
+
+	// execute
+	recovered := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+
+	// asserts: the records already in the snapshot are not applied twice
+	chain, err := recovered.GetSigningChain("device-1")
+	assert.NoError(t, err)
+	assert.Len(t, chain, 6)
+}
+
+func TestJournaledStorageRefusesDamagedJournal(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(journal []byte) []byte
+	}{
+		{
+			name: "truncated record",
+			damage: func(journal []byte) []byte {
+				return journal[:len(journal)-3]
+			},
+		},
+		{
+			name: "truncated header",
+			damage: func(journal []byte) []byte {
+				return append(journal, 0, 0, 0)
+			},
+		},
+		{
+			name: "flipped bit",
+			damage: func(journal []byte) []byte {
+				journal[len(journal)-10] ^= 0x01
+				return journal
+			},
+		},
+		{
+			name: "missing record",
+			damage: func(journal []byte) []byte {
+				first, err := readFrame(bytes.NewReader(journal))
+				assert.NoError(t, err)
+				second, err := readFrame(bytes.NewReader(journal[frameHeaderSize+len(first):]))
+				assert.NoError(t, err)
+				// keep the device record and drop the first signing, the journal itself is intact
+				return append(journal[:frameHeaderSize+len(first)], journal[2*frameHeaderSize+len(first)+len(second):]...)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			dir := t.TempDir()
+			store := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+			fillJournal(t, store, 3)
+			assert.NoError(t, store.Close())
+
+			path := filepath.Join(dir, journalFileName)
+			journal, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.NoError(t, os.WriteFile(path, test.damage(journal), 0o600))
+
+			// execute
+			_, err = NewJournaledStorage(JournalOptions{Dir: dir, Sync: SyncAlways})
+
+			// asserts
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestJournaledStorageRefusesDamagedSnapshot(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	store := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+	fillJournal(t, store, 3)
+	assert.NoError(t, store.Compact())
+	assert.NoError(t, store.Close())
+
+	path := filepath.Join(dir, snapshotFileName)
+	snapshot, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, snapshot[:len(snapshot)/2], 0o600))
+
+	// execute
+	_, err = NewJournaledStorage(JournalOptions{Dir: dir, Sync: SyncAlways})
+
+	// asserts
+	assert.Error(t, err)
+}
+
+func TestJournaledStorageRecoversDeviceStateAndDetails(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	store := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+	fillJournal(t, store, 2)
+	label := "till 2"
+	assert.NoError(t, store.UpdateDeviceDetails("device-1", 1, &label, map[string]string{"store": "berlin-1"}))
+	decommissionedAt := time.Now().UTC()
+	assert.NoError(t, store.UpdateDeviceState("device-1", domain.DeviceStateActive, domain.DeviceStateDecommissioned, func() time.Time { return decommissionedAt }))
+	assert.NoError(t, store.Close())
+
+	// execute
+	recovered := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+
+	// asserts
+	device, err := recovered.FindByID("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.DeviceStateDecommissioned, device.State)
+	assert.True(t, decommissionedAt.Equal(device.StateChangedAt))
+	assert.Equal(t, int64(2), device.Counter)
+	assert.Equal(t, int64(2), device.Version)
+	assert.Equal(t, "till 2", *device.Label)
+	assert.Equal(t, map[string]string{"store": "berlin-1"}, device.Metadata)
+}
+
+func TestJournaledStorageRecoversKeys(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	store := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+	fillJournal(t, store, 2)
+	_, err := store.RotateDeviceKey("device-1", domain.DeviceSigner{ID: "key-2", KeyHandle: "handle-2"})
+	assert.NoError(t, err)
+	appendTestSigning(t, store)
+	assert.NoError(t, store.Close())
+
+	// execute
+	recovered := newJournaledTestStorage(t, JournalOptions{Dir: dir, Sync: SyncAlways})
+
+	// asserts
+	device, err := recovered.FindByID("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "key-2", device.KeyID)
+	assert.Equal(t, "handle-2", device.KeyHandle)
+	signers, err := recovered.GetDeviceSigners("device-1")
+	assert.NoError(t, err)
+	assert.Len(t, signers, 2)
+	chain, err := recovered.GetSigningChain("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "handle-1", chain[1].KeyID, "the first key of a device without key id is its handle")
+	assert.Equal(t, "key-2", chain[2].KeyID)
+}
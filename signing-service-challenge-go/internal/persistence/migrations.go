@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration is one schema change, named <version>_<description>.sql in migrations/<dialect>.
+type migration struct {
+	version   int
+	name      string
+	statement string
+}
+
+// loadMigrations reads the migrations of a dialect sorted by version.
+func loadMigrations(dialect string) ([]migration, error) {
+	directory := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %s: %v", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(migrationFiles, path.Join(directory, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version:   version,
+			name:      entry.Name(),
+			statement: string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// applyMigrations runs, inside tx, every migration newer than the latest version recorded in schema_migrations.
+// The caller is responsible for serializing concurrent runs and for committing tx.
+func applyMigrations(tx *sql.Tx, migrations []migration, recordVersion string) (int, error) {
+	var current int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if _, err := tx.Exec(m.statement); err != nil {
+			return applied, fmt.Errorf("migration %s failed: %v", m.name, err)
+		}
+		if _, err := tx.Exec(recordVersion, m.version); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
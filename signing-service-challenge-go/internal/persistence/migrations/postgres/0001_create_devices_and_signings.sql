@@ -0,0 +1,21 @@
+CREATE TABLE devices (
+    id                TEXT PRIMARY KEY,
+    algorithm         TEXT        NOT NULL,
+    curve             TEXT        NOT NULL DEFAULT '',
+    key_size          INTEGER     NOT NULL DEFAULT 0,
+    padding           TEXT        NOT NULL DEFAULT '',
+    label             TEXT,
+    key_handle        TEXT        NOT NULL,
+    signature_counter BIGINT      NOT NULL DEFAULT 0,
+    last_signature    TEXT        NOT NULL DEFAULT '',
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE signings (
+    id          UUID PRIMARY KEY,
+    device_id   TEXT   NOT NULL REFERENCES devices (id),
+    counter     BIGINT NOT NULL,
+    signature   TEXT   NOT NULL,
+    signed_data TEXT   NOT NULL,
+    UNIQUE (device_id, counter)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE devices
+    ADD COLUMN state            TEXT NOT NULL DEFAULT 'ACTIVE',
+    ADD COLUMN state_changed_at TIMESTAMPTZ;
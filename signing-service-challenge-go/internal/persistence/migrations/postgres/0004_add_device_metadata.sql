@@ -0,0 +1,3 @@
+ALTER TABLE devices
+    ADD COLUMN metadata JSONB  NOT NULL DEFAULT '{}',
+    ADD COLUMN version  BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,2 @@
+-- devices are listed by creation time, then id.
+CREATE INDEX devices_created_at_id ON devices (created_at, id);
@@ -0,0 +1,21 @@
+CREATE TABLE devices (
+    id                TEXT PRIMARY KEY,
+    algorithm         TEXT    NOT NULL,
+    curve             TEXT    NOT NULL DEFAULT '',
+    key_size          INTEGER NOT NULL DEFAULT 0,
+    padding           TEXT    NOT NULL DEFAULT '',
+    label             TEXT,
+    key_handle        TEXT    NOT NULL,
+    signature_counter INTEGER NOT NULL DEFAULT 0,
+    last_signature    TEXT    NOT NULL DEFAULT '',
+    created_at        TEXT    NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+CREATE TABLE signings (
+    id          TEXT PRIMARY KEY,
+    device_id   TEXT    NOT NULL REFERENCES devices (id),
+    counter     INTEGER NOT NULL,
+    signature   TEXT    NOT NULL,
+    signed_data TEXT    NOT NULL,
+    UNIQUE (device_id, counter)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE devices ADD COLUMN state TEXT NOT NULL DEFAULT 'ACTIVE';
+ALTER TABLE devices ADD COLUMN state_changed_at TIMESTAMP;
@@ -0,0 +1,26 @@
+-- every key a device has signed with, the devices table keeps the active one.
+-- The key of the existing devices gets its handle as id.
+ALTER TABLE devices ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE devices ADD COLUMN key_created_at TIMESTAMP;
+
+UPDATE devices SET key_id = key_handle;
+
+CREATE TABLE device_keys (
+    device_id  TEXT    NOT NULL REFERENCES devices (id),
+    version    INTEGER NOT NULL,
+    id         TEXT    NOT NULL,
+    created_at TIMESTAMP,
+    algorithm  TEXT    NOT NULL,
+    curve      TEXT    NOT NULL DEFAULT '',
+    key_size   INTEGER NOT NULL DEFAULT 0,
+    padding    TEXT    NOT NULL DEFAULT '',
+    key_handle TEXT    NOT NULL,
+    PRIMARY KEY (device_id, version)
+);
+
+INSERT INTO device_keys (device_id, version, id, created_at, algorithm, curve, key_size, padding, key_handle)
+SELECT id, 1, key_id, key_created_at, algorithm, curve, key_size, padding, key_handle FROM devices;
+
+ALTER TABLE signings ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+
+UPDATE signings SET key_id = (SELECT devices.key_id FROM devices WHERE devices.id = signings.device_id);
@@ -0,0 +1,2 @@
+ALTER TABLE devices ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE devices ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
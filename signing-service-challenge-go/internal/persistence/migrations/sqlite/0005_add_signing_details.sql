@@ -0,0 +1,7 @@
+-- when a signing was requested, the algorithm of the key that signed it and the metadata of the client.
+-- Existing signings have no time, their algorithm is the one of their device.
+ALTER TABLE signings ADD COLUMN algorithm TEXT NOT NULL DEFAULT '';
+ALTER TABLE signings ADD COLUMN created_at TIMESTAMP;
+ALTER TABLE signings ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
+
+UPDATE signings SET algorithm = (SELECT devices.algorithm FROM devices WHERE devices.id = signings.device_id);
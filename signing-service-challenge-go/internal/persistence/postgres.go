@@ -0,0 +1,342 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// postgresMigrationLock is the advisory lock key that keeps several instances from migrating at the same time.
+const postgresMigrationLock = 7_340_912
+
+const postgresUniqueViolation = "23505"
+
+// PostgresStorage keeps devices and signings in PostgreSQL. The signature counter of a device is only
+// advanced inside a transaction holding the device row lock, so it stays gapless across service instances.
+type PostgresStorage struct {
+	db *sql.DB
+}
+
+// NewPostgresStorage connects to the database behind dsn and brings its schema up to date.
+func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &PostgresStorage{db: db}
+	if err = storage.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (p *PostgresStorage) Close() error {
+	return p.db.Close()
+}
+
+func (p *PostgresStorage) migrate() error {
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		return err
+	}
+
+	return inTransaction(p.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", postgresMigrationLock); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+			return err
+		}
+		_, err := applyMigrations(tx, migrations, "INSERT INTO schema_migrations (version) VALUES ($1)")
+		return err
+	})
+}
+
+// postgresDialect numbers the parameters and compares created_at as timestamptz. Text is sorted in the C collation,
+// the collation of the database depends on its locale.
+var postgresDialect = sqlDialect{
+	placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	time:        func(t time.Time) any { return t },
+	like:        "ILIKE",
+	bytewise:    func(column string) string { return column + ` COLLATE "C"` },
+}
+
+func (p *PostgresStorage) GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error) {
+	return getAllDevices(p.db, postgresDialect, filter, pageNr, pageSize)
+}
+
+func (p *PostgresStorage) GetDevicesPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error) {
+	return getDevicesPage(p.db, postgresDialect, filter, cursor, pageSize)
+}
+
+// Save stores the device together with its first key.
+func (p *PostgresStorage) Save(device domain.Device) error {
+	device = storedDevice(device)
+	metadata, err := encodeMetadata(device.Metadata)
+	if err != nil {
+		return err
+	}
+	err = inTransaction(p.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO devices (`+deviceColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, COALESCE($15, now()))`,
+			device.ID, device.AlgorithmType, device.Options.Curve, device.Options.KeySize, device.Options.Padding,
+			device.Label, metadata, device.Version, device.KeyID, nullTime(device.KeyCreatedAt), device.KeyHandle, device.Counter, device.State,
+			nullTime(device.StateChangedAt), nullTime(device.CreatedAt)); err != nil {
+			return err
+		}
+		return p.insertSigner(tx, initialSigner(device))
+	})
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation {
+		return domain.ErrDeviceExists
+	}
+	return err
+}
+
+// UpdateDeviceState checks the state and reads the clock while holding the device row lock, so it waits for a signing
+// in progress, also on other instances, and the change is never stamped before it.
+func (p *PostgresStorage) UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error {
+	return inTransaction(p.db, func(tx *sql.Tx) error {
+		var state domain.DeviceState
+		err := tx.QueryRow("SELECT state FROM devices WHERE id = $1 FOR UPDATE", id).Scan(&state)
+		if errors.Is(err, sql.ErrNoRows) {
+			return services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+		}
+		if err != nil {
+			return err
+		}
+		if state != from {
+			return services.NewConflictError(services.CodeDeviceModified, "device state was changed concurrently, please retry")
+		}
+		_, err = tx.Exec("UPDATE devices SET state = $2, state_changed_at = $3 WHERE id = $1", id, to, clock())
+		return err
+	})
+}
+
+// UpdateDeviceDetails only matches the device while it is at version, the update waits for the row lock a signing in progress holds.
+func (p *PostgresStorage) UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error {
+	encoded, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	result, err := p.db.Exec("UPDATE devices SET label = $3, metadata = $4, version = version + 1 WHERE id = $1 AND version = $2", id, version, label, encoded)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, func() error {
+		_, err := p.FindByID(id)
+		return err
+	}, services.NewPreconditionFailedError(services.CodeDeviceModified, "device was modified concurrently, fetch it and retry"))
+}
+
+func (p *PostgresStorage) FindByID(id string) (*domain.Device, error) {
+	row := p.db.QueryRow(`SELECT `+deviceColumns+`
+		FROM devices WHERE id = $1`, id)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+	return device, err
+}
+
+func (p *PostgresStorage) GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error) {
+	var total int
+	if err := p.db.QueryRow("SELECT COUNT(*) FROM signings WHERE device_id = $1", deviceId).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if total == 0 {
+		// without signings the device may not exist, it is reported like in cursor mode
+		if _, err := p.FindByID(deviceId); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, nil
+	}
+	offset, ok := pageOffset(pageNr, pageSize)
+	if !ok {
+		return []*domain.Signings{}, total, nil
+	}
+
+	rows, err := p.db.Query(`SELECT `+signingColumns+`
+		FROM signings WHERE device_id = $1 ORDER BY counter LIMIT $2 OFFSET $3`, deviceId, pageSize, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	result, err := scanSignings(rows)
+	return result, total, err
+}
+
+func (p *PostgresStorage) GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) ([]*domain.Signings, bool, error) {
+	if _, err := p.FindByID(deviceId); err != nil {
+		return nil, false, err
+	}
+
+	query := `SELECT ` + signingColumns + ` FROM signings WHERE device_id = $1 ORDER BY counter LIMIT $2`
+	args := []any{deviceId, pageSize + 1}
+	if cursor != nil {
+		comparison, order := pageDirection(cursor)
+		query = `SELECT ` + signingColumns + ` FROM signings WHERE device_id = $1 AND counter ` + comparison + ` $2
+			ORDER BY counter ` + order + ` LIMIT $3`
+		args = []any{deviceId, cursor.Counter, pageSize + 1}
+	}
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	signings, err := scanSignings(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	signings, more := limitPage(signings, cursor, pageSize)
+	return signings, more, nil
+}
+
+func (p *PostgresStorage) GetSigningChain(deviceId string) ([]*domain.Signings, error) {
+	if _, err := p.FindByID(deviceId); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query(`SELECT `+signingColumns+`
+		FROM signings WHERE device_id = $1 ORDER BY counter`, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSignings(rows)
+}
+
+// GetSigningByCounter tells an unknown device apart from a counter the device hasn't reached.
+func (p *PostgresStorage) GetSigningByCounter(deviceId string, counter int64) (*domain.Signings, error) {
+	if _, err := p.FindByID(deviceId); err != nil {
+		return nil, err
+	}
+	return signingFound(scanSigning(p.db.QueryRow(`SELECT `+signingColumns+`
+		FROM signings WHERE device_id = $1 AND counter = $2`, deviceId, counter)))
+}
+
+// GetSigningByID looks the id up as the UUID it is stored as, anything else can't be a signing.
+func (p *PostgresStorage) GetSigningByID(id string) (*domain.Signings, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return signingFound(nil, sql.ErrNoRows)
+	}
+	return signingFound(scanSigning(p.db.QueryRow(`SELECT `+signingColumns+` FROM signings WHERE id = $1`, id)))
+}
+
+// AppendSigning locks the device row for the whole call, so concurrent signings of the device queue up behind it,
+// also across instances sharing the database, and the counter stays gapless.
+func (p *PostgresStorage) AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error) {
+	var signing *domain.Signings
+	err := inTransaction(p.db, func(tx *sql.Tx) error {
+		var counter int64
+		var lastSignature string
+		var state domain.DeviceState
+		var keyHandle string
+		device := domain.Device{ID: deviceId}
+		err := tx.QueryRow("SELECT signature_counter, last_signature, state, algorithm, key_id, key_handle FROM devices WHERE id = $1 FOR UPDATE", deviceId).
+			Scan(&counter, &lastSignature, &state, &device.AlgorithmType, &device.KeyID, &keyHandle)
+		if errors.Is(err, sql.ErrNoRows) {
+			return services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+		}
+		if err != nil {
+			return err
+		}
+		if state != domain.DeviceStateActive {
+			return &domain.DeviceNotActiveError{State: state}
+		}
+
+		signature, signedData, err := sign(counter+1, lastSignature, keyHandle)
+		if err != nil {
+			return err
+		}
+		signing = newSigning(&device, counter+1, signature, signedData, details)
+		metadata, err := encodeMetadata(signing.Metadata)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`INSERT INTO signings (`+signingColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			signing.ID, deviceId, signing.Counter, signing.Signature, signing.SignedData, signing.KeyID, signing.Algorithm, nullTime(signing.CreatedAt), metadata); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE devices SET signature_counter = $2, last_signature = $3 WHERE id = $1", deviceId, signing.Counter, signing.Signature)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signing, nil
+}
+
+// RotateDeviceKey checks the state, numbers and stores the signer while holding the device row lock, so it waits for a
+// signing or a state change in progress, also on other instances.
+func (p *PostgresStorage) RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error) {
+	err := inTransaction(p.db, func(tx *sql.Tx) error {
+		var state domain.DeviceState
+		err := tx.QueryRow("SELECT state FROM devices WHERE id = $1 FOR UPDATE", deviceId).Scan(&state)
+		if errors.Is(err, sql.ErrNoRows) {
+			return services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+		}
+		if err != nil {
+			return err
+		}
+		if state == domain.DeviceStateDecommissioned {
+			return services.NewConflictError(services.CodeDeviceDecommissioned, "a decommissioned device can't get new keys")
+		}
+		if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM device_keys WHERE device_id = $1", deviceId).Scan(&signer.Version); err != nil {
+			return err
+		}
+
+		signer.DeviceId = deviceId
+		if err = p.insertSigner(tx, &signer); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE devices SET key_id = $2, key_created_at = $3, key_handle = $4 WHERE id = $1",
+			deviceId, signer.ID, nullTime(signer.CreatedAt), signer.KeyHandle)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &signer, nil
+}
+
+func (p *PostgresStorage) GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error) {
+	if _, err := p.FindByID(deviceId); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query(`SELECT `+signerColumns+`
+		FROM device_keys WHERE device_id = $1 ORDER BY version`, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSigners(rows)
+}
+
+func (p *PostgresStorage) insertSigner(tx *sql.Tx, signer *domain.DeviceSigner) error {
+	_, err := tx.Exec(`INSERT INTO device_keys (`+signerColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		signer.ID, signer.DeviceId, signer.Version, nullTime(signer.CreatedAt), signer.AlgorithmType,
+		signer.Options.Curve, signer.Options.KeySize, signer.Options.Padding, signer.KeyHandle)
+	return err
+}
@@ -0,0 +1,43 @@
+package persistence
+
+import (
+	"os"
+	"testing"
+)
+
+// The PostgreSQL tests need a database they are allowed to wipe, e.g. the one started by `make test-postgres`.
+func newPostgresTestStorage(t *testing.T) *PostgresStorage {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	store, err := NewPostgresStorage(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.db.Exec("TRUNCATE signings, device_keys, devices"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestPostgresStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return newPostgresTestStorage(t)
+	})
+}
+
+func TestPostgresConcurrentCounter(t *testing.T) {
+	first := newPostgresTestStorage(t)
+	second, err := NewPostgresStorage(os.Getenv("POSTGRES_TEST_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	testConcurrentCounter(t, []Storage{first, second})
+}
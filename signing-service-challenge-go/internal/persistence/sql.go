@@ -0,0 +1,360 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// helpers shared by the database/sql based storages
+
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// deviceColumns are the columns scanDevice expects, in its order.
+const deviceColumns = "id, algorithm, curve, key_size, padding, label, metadata, version, key_id, key_created_at, key_handle, signature_counter, state, state_changed_at, created_at"
+
+// signingColumns are the columns scanSignings expects, in its order.
+const signingColumns = "id, device_id, counter, signature, signed_data, key_id, algorithm, created_at, metadata"
+
+// signerColumns are the columns scanSigners expects, in its order.
+const signerColumns = "id, device_id, version, created_at, algorithm, curve, key_size, padding, key_handle"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDevice(row rowScanner) (*domain.Device, error) {
+	var device domain.Device
+	var label sql.NullString
+	var metadata []byte
+	var keyCreatedAt, stateChangedAt sql.NullTime
+	var createdAt timestamp
+	err := row.Scan(&device.ID, &device.AlgorithmType, &device.Options.Curve, &device.Options.KeySize,
+		&device.Options.Padding, &label, &metadata, &device.Version, &device.KeyID, &keyCreatedAt, &device.KeyHandle, &device.Counter, &device.State, &stateChangedAt,
+		&createdAt)
+	if err != nil {
+		return nil, err
+	}
+	device.CreatedAt = createdAt.Time
+	if label.Valid {
+		device.Label = &label.String
+	}
+	if err = json.Unmarshal(metadata, &device.Metadata); err != nil {
+		return nil, err
+	}
+	if len(device.Metadata) == 0 {
+		device.Metadata = nil
+	}
+	if keyCreatedAt.Valid {
+		device.KeyCreatedAt = keyCreatedAt.Time
+	}
+	if stateChangedAt.Valid {
+		device.StateChangedAt = stateChangedAt.Time
+	}
+	return &device, nil
+}
+
+func scanDevices(rows *sql.Rows) ([]*domain.Device, error) {
+	result := []*domain.Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, device)
+	}
+	return result, rows.Err()
+}
+
+func scanSigning(row rowScanner) (*domain.Signings, error) {
+	var signing domain.Signings
+	var createdAt sql.NullTime
+	var metadata []byte
+	err := row.Scan(&signing.ID, &signing.DeviceId, &signing.Counter, &signing.Signature, &signing.SignedData, &signing.KeyID,
+		&signing.Algorithm, &createdAt, &metadata)
+	if err != nil {
+		return nil, err
+	}
+	if createdAt.Valid {
+		signing.CreatedAt = createdAt.Time
+	}
+	if err = json.Unmarshal(metadata, &signing.Metadata); err != nil {
+		return nil, err
+	}
+	if len(signing.Metadata) == 0 {
+		signing.Metadata = nil
+	}
+	return &signing, nil
+}
+
+func scanSignings(rows *sql.Rows) ([]*domain.Signings, error) {
+	result := []*domain.Signings{}
+	for rows.Next() {
+		signing, err := scanSigning(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, signing)
+	}
+	return result, rows.Err()
+}
+
+// timestamp scans a time stored as a timestamp or, like the column defaults of sqlite, as RFC 3339 text.
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) Scan(value any) error {
+	switch value := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = value
+	case string:
+		return t.parse(value)
+	case []byte:
+		return t.parse(string(value))
+	default:
+		return fmt.Errorf("can't scan %T into a timestamp", value)
+	}
+	return nil
+}
+
+func (t *timestamp) parse(value string) error {
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// sqlDialect is what the device listings of the databases differ in.
+type sqlDialect struct {
+	// placeholder is the marker of the nth parameter, counting from 1
+	placeholder func(n int) string
+	// time converts a time into the parameter compared with created_at
+	time func(t time.Time) any
+	// like is the case insensitive LIKE operator
+	like string
+	// bytewise makes a text column compare byte by byte, like Go strings, whatever the collation of the database
+	bytewise func(column string) string
+}
+
+// deviceQuery collects the conditions of a device listing and their parameters.
+type deviceQuery struct {
+	dialect    sqlDialect
+	conditions []string
+	args       []any
+}
+
+// newDeviceQuery turns the filter into the conditions of a device listing.
+func newDeviceQuery(dialect sqlDialect, filter domain.DeviceFilter) *deviceQuery {
+	q := &deviceQuery{dialect: dialect}
+	if filter.Algorithm != "" {
+		q.where("algorithm = " + q.arg(filter.Algorithm))
+	}
+	if filter.State != "" {
+		q.where("state = " + q.arg(filter.State))
+	}
+	if filter.Label != "" {
+		q.where("label " + dialect.like + " " + q.arg("%"+likeEscaper.Replace(filter.Label)+"%") + ` ESCAPE '\'`)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		q.where("created_at >= " + q.arg(dialect.time(filter.CreatedFrom)))
+	}
+	if !filter.CreatedTo.IsZero() {
+		q.where("created_at < " + q.arg(dialect.time(filter.CreatedTo)))
+	}
+	if filter.MinCounter != nil {
+		q.where("signature_counter >= " + q.arg(*filter.MinCounter))
+	}
+	if filter.MaxCounter != nil {
+		q.where("signature_counter <= " + q.arg(*filter.MaxCounter))
+	}
+	return q
+}
+
+// likeEscaper makes the wildcards of a LIKE pattern match themselves.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// arg adds a parameter and returns its marker.
+func (q *deviceQuery) arg(value any) string {
+	q.args = append(q.args, value)
+	return q.dialect.placeholder(len(q.args))
+}
+
+func (q *deviceQuery) where(condition string) {
+	q.conditions = append(q.conditions, condition)
+}
+
+func (q *deviceQuery) whereClause() string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+// deviceOrder is the ORDER BY of the sort of the filter, ties are broken by id.
+func deviceOrder(dialect sqlDialect, filter domain.DeviceFilter) string {
+	direction := "ASC"
+	if filter.Descending {
+		direction = "DESC"
+	}
+	id := dialect.bytewise("id") + " " + direction
+	switch filter.Sort {
+	case domain.DeviceSortID:
+		return id
+	case domain.DeviceSortLabel:
+		return dialect.bytewise("COALESCE(label, '')") + " " + direction + ", " + id
+	case domain.DeviceSortCounter:
+		return "signature_counter " + direction + ", " + id
+	default:
+		return "created_at " + direction + ", " + id
+	}
+}
+
+// getAllDevices implements Storage.GetAll for the database/sql based storages.
+func getAllDevices(db *sql.DB, dialect sqlDialect, filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error) {
+	q := newDeviceQuery(dialect, filter)
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM devices"+q.whereClause(), q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	offset, ok := pageOffset(pageNr, pageSize)
+	if !ok {
+		return []*domain.Device{}, total, nil
+	}
+
+	query := `SELECT ` + deviceColumns + ` FROM devices` + q.whereClause() + ` ORDER BY ` + deviceOrder(dialect, filter)
+	query += ` LIMIT ` + q.arg(pageSize) + ` OFFSET ` + q.arg(offset)
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	result, err := scanDevices(rows)
+	return result, total, err
+}
+
+// getDevicesPage implements Storage.GetDevicesPage for the database/sql based storages.
+func getDevicesPage(db *sql.DB, dialect sqlDialect, filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error) {
+	q := newDeviceQuery(dialect, filter)
+	order := "ASC"
+	if cursor != nil {
+		var comparison string
+		comparison, order = pageDirection(cursor)
+		q.where("(created_at, " + dialect.bytewise("id") + ") " + comparison + " (" + q.arg(dialect.time(cursor.CreatedAt)) + ", " + q.arg(cursor.ID) + ")")
+	}
+	query := `SELECT ` + deviceColumns + ` FROM devices` + q.whereClause() +
+		` ORDER BY created_at ` + order + `, ` + dialect.bytewise("id") + ` ` + order + ` LIMIT ` + q.arg(pageSize+1)
+	rows, err := db.Query(query, q.args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	devices, err := scanDevices(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	devices, more := limitPage(devices, cursor, pageSize)
+	return devices, more, nil
+}
+
+// pageDirection is the comparison with the cursor and the sort order selecting the page next to it, backward pages
+// are read in descending order.
+func pageDirection(cursor *domain.PageCursor) (string, string) {
+	if cursor.Backward {
+		return "<", "DESC"
+	}
+	return ">", "ASC"
+}
+
+// limitPage drops the extra row read to find out whether more are left and puts backward pages in listing order.
+func limitPage[T any](items []*T, cursor *domain.PageCursor, pageSize int) ([]*T, bool) {
+	more := len(items) > pageSize
+	if more {
+		items = items[:pageSize]
+	}
+	if cursor != nil && cursor.Backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	return items, more
+}
+
+// signingFound maps a missing row to signing_not_found.
+func signingFound(signing *domain.Signings, err error) (*domain.Signings, error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, services.NewNotFoundError(services.CodeSigningNotFound, "signing not found")
+	}
+	return signing, err
+}
+
+func scanSigners(rows *sql.Rows) ([]*domain.DeviceSigner, error) {
+	result := []*domain.DeviceSigner{}
+	for rows.Next() {
+		var signer domain.DeviceSigner
+		var createdAt sql.NullTime
+		if err := rows.Scan(&signer.ID, &signer.DeviceId, &signer.Version, &createdAt, &signer.AlgorithmType,
+			&signer.Options.Curve, &signer.Options.KeySize, &signer.Options.Padding, &signer.KeyHandle); err != nil {
+			return nil, err
+		}
+		if createdAt.Valid {
+			signer.CreatedAt = createdAt.Time
+		}
+		result = append(result, &signer)
+	}
+	return result, rows.Err()
+}
+
+// encodeMetadata stores the metadata as a JSON object, {} when there is none.
+func encodeMetadata(metadata map[string]string) (string, error) {
+	if metadata == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(metadata)
+	return string(encoded), err
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// checkUpdated tells a device that is gone, found through exists, from one that no longer matched the update,
+// which is reported as conflict.
+func checkUpdated(result sql.Result, exists func() error, conflict error) error {
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 1 {
+		return nil
+	}
+	if err = exists(); err != nil {
+		return err
+	}
+	return conflict
+}
@@ -0,0 +1,367 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// SQLiteStorage keeps devices and signings in a single SQLite file, for single node deployments without a database server.
+// The database runs in WAL mode and every transaction takes the write lock up front (BEGIN IMMEDIATE),
+// so reading and advancing the signature counter can't interleave with another writer.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// NewSQLiteStorage opens, or creates, the database file at path and brings its schema up to date.
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	// the path goes into a file: URI, where a "?" or "#" in a file name would cut it short
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "synchronous(FULL)")
+	query.Add("_pragma", "busy_timeout(5000)")
+	query.Add("_pragma", "foreign_keys(ON)")
+	query.Set("_txlock", "immediate")
+	dsn := url.URL{Scheme: "file", Path: absPath, RawQuery: query.Encode()}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &SQLiteStorage{db: db}
+	if err = storage.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStorage) migrate() error {
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		return err
+	}
+
+	return inTransaction(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+		)`); err != nil {
+			return err
+		}
+		_, err := applyMigrations(tx, migrations, "INSERT INTO schema_migrations (version) VALUES (?)")
+		return err
+	})
+}
+
+// sqliteTimeLayout is the format of strftime('%Y-%m-%dT%H:%M:%fZ'), the default of the created_at columns.
+const sqliteTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// sqliteDialect compares created_at as text in the format of its default, LIKE ignores the case of ASCII letters and
+// text is compared byte by byte already. Bounds are rounded up to the millisecond the text keeps, which selects the
+// same creation times as the exact bound.
+var sqliteDialect = sqlDialect{
+	placeholder: func(int) string { return "?" },
+	time: func(t time.Time) any {
+		if rounded := t.Truncate(time.Millisecond); rounded.Before(t) {
+			t = rounded.Add(time.Millisecond)
+		}
+		return sqliteTime(t)
+	},
+	like:     "LIKE",
+	bytewise: func(column string) string { return column },
+}
+
+func (s *SQLiteStorage) GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error) {
+	return getAllDevices(s.db, sqliteDialect, filter, pageNr, pageSize)
+}
+
+func (s *SQLiteStorage) GetDevicesPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error) {
+	return getDevicesPage(s.db, sqliteDialect, filter, cursor, pageSize)
+}
+
+// Save stores the device together with its first key.
+func (s *SQLiteStorage) Save(device domain.Device) error {
+	device = storedDevice(device)
+	metadata, err := encodeMetadata(device.Metadata)
+	if err != nil {
+		return err
+	}
+	err = inTransaction(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO devices (`+deviceColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(?, strftime('%Y-%m-%dT%H:%M:%fZ', 'now')))`,
+			device.ID, device.AlgorithmType, device.Options.Curve, device.Options.KeySize, device.Options.Padding,
+			device.Label, metadata, device.Version, device.KeyID, nullTime(device.KeyCreatedAt), device.KeyHandle, device.Counter, device.State,
+			nullTime(device.StateChangedAt), sqliteTime(device.CreatedAt)); err != nil {
+			return err
+		}
+		return s.insertSigner(tx, initialSigner(device))
+	})
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return domain.ErrDeviceExists
+	}
+	return err
+}
+
+// UpdateDeviceState checks the state and reads the clock in a transaction that holds the write lock of the database,
+// so it waits for a signing in progress and the change is never stamped before it.
+func (s *SQLiteStorage) UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error {
+	return inTransaction(s.db, func(tx *sql.Tx) error {
+		var state domain.DeviceState
+		err := tx.QueryRow("SELECT state FROM devices WHERE id = ?", id).Scan(&state)
+		if errors.Is(err, sql.ErrNoRows) {
+			return services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+		}
+		if err != nil {
+			return err
+		}
+		if state != from {
+			return services.NewConflictError(services.CodeDeviceModified, "device state was changed concurrently, please retry")
+		}
+		_, err = tx.Exec("UPDATE devices SET state = ?, state_changed_at = ? WHERE id = ?", to, clock(), id)
+		return err
+	})
+}
+
+// UpdateDeviceDetails only matches the device while it is at version, like every write it waits for the write lock a signing in progress holds.
+func (s *SQLiteStorage) UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error {
+	encoded, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE devices SET label = ?, metadata = ?, version = version + 1 WHERE id = ? AND version = ?", label, encoded, id, version)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, func() error {
+		_, err := s.FindByID(id)
+		return err
+	}, services.NewPreconditionFailedError(services.CodeDeviceModified, "device was modified concurrently, fetch it and retry"))
+}
+
+func (s *SQLiteStorage) FindByID(id string) (*domain.Device, error) {
+	row := s.db.QueryRow(`SELECT `+deviceColumns+`
+		FROM devices WHERE id = ?`, id)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+	return device, err
+}
+
+func (s *SQLiteStorage) GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM signings WHERE device_id = ?", deviceId).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if total == 0 {
+		// without signings the device may not exist, it is reported like in cursor mode
+		if _, err := s.FindByID(deviceId); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, nil
+	}
+	offset, ok := pageOffset(pageNr, pageSize)
+	if !ok {
+		return []*domain.Signings{}, total, nil
+	}
+
+	rows, err := s.db.Query(`SELECT `+signingColumns+`
+		FROM signings WHERE device_id = ? ORDER BY counter LIMIT ? OFFSET ?`, deviceId, pageSize, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	result, err := scanSignings(rows)
+	return result, total, err
+}
+
+func (s *SQLiteStorage) GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) ([]*domain.Signings, bool, error) {
+	if _, err := s.FindByID(deviceId); err != nil {
+		return nil, false, err
+	}
+
+	query := `SELECT ` + signingColumns + ` FROM signings WHERE device_id = ? ORDER BY counter LIMIT ?`
+	args := []any{deviceId, pageSize + 1}
+	if cursor != nil {
+		comparison, order := pageDirection(cursor)
+		query = `SELECT ` + signingColumns + ` FROM signings WHERE device_id = ? AND counter ` + comparison + ` ?
+			ORDER BY counter ` + order + ` LIMIT ?`
+		args = []any{deviceId, cursor.Counter, pageSize + 1}
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	signings, err := scanSignings(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	signings, more := limitPage(signings, cursor, pageSize)
+	return signings, more, nil
+}
+
+// sqliteTime formats t like the created_at defaults of the schema, so the text compares in time order.
+// A zero time is stored as NULL.
+func sqliteTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func (s *SQLiteStorage) GetSigningChain(deviceId string) ([]*domain.Signings, error) {
+	if _, err := s.FindByID(deviceId); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT `+signingColumns+`
+		FROM signings WHERE device_id = ? ORDER BY counter`, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSignings(rows)
+}
+
+// GetSigningByCounter tells an unknown device apart from a counter the device hasn't reached.
+func (s *SQLiteStorage) GetSigningByCounter(deviceId string, counter int64) (*domain.Signings, error) {
+	if _, err := s.FindByID(deviceId); err != nil {
+		return nil, err
+	}
+	return signingFound(scanSigning(s.db.QueryRow(`SELECT `+signingColumns+`
+		FROM signings WHERE device_id = ? AND counter = ?`, deviceId, counter)))
+}
+
+func (s *SQLiteStorage) GetSigningByID(id string) (*domain.Signings, error) {
+	return signingFound(scanSigning(s.db.QueryRow(`SELECT `+signingColumns+` FROM signings WHERE id = ?`, id)))
+}
+
+// AppendSigning runs in a transaction that holds the write lock of the database from its start,
+// so concurrent signings queue up behind it and the counter stays gapless.
+func (s *SQLiteStorage) AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error) {
+	var signing *domain.Signings
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		var counter int64
+		var lastSignature string
+		var state domain.DeviceState
+		var keyHandle string
+		device := domain.Device{ID: deviceId}
+		err := tx.QueryRow("SELECT signature_counter, last_signature, state, algorithm, key_id, key_handle FROM devices WHERE id = ?", deviceId).
+			Scan(&counter, &lastSignature, &state, &device.AlgorithmType, &device.KeyID, &keyHandle)
+		if errors.Is(err, sql.ErrNoRows) {
+			return services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+		}
+		if err != nil {
+			return err
+		}
+		if state != domain.DeviceStateActive {
+			return &domain.DeviceNotActiveError{State: state}
+		}
+
+		signature, signedData, err := sign(counter+1, lastSignature, keyHandle)
+		if err != nil {
+			return err
+		}
+		signing = newSigning(&device, counter+1, signature, signedData, details)
+		metadata, err := encodeMetadata(signing.Metadata)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(`INSERT INTO signings (`+signingColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			signing.ID, deviceId, signing.Counter, signing.Signature, signing.SignedData, signing.KeyID, signing.Algorithm, nullTime(signing.CreatedAt), metadata); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE devices SET signature_counter = ?, last_signature = ? WHERE id = ?", signing.Counter, signing.Signature, deviceId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signing, nil
+}
+
+// RotateDeviceKey checks the state, numbers and stores the signer while holding the write lock of the database, so it
+// waits for a signing or a state change in progress.
+func (s *SQLiteStorage) RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error) {
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		var state domain.DeviceState
+		err := tx.QueryRow("SELECT state FROM devices WHERE id = ?", deviceId).Scan(&state)
+		if errors.Is(err, sql.ErrNoRows) {
+			return services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+		}
+		if err != nil {
+			return err
+		}
+		if state == domain.DeviceStateDecommissioned {
+			return services.NewConflictError(services.CodeDeviceDecommissioned, "a decommissioned device can't get new keys")
+		}
+		if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM device_keys WHERE device_id = ?", deviceId).Scan(&signer.Version); err != nil {
+			return err
+		}
+
+		signer.DeviceId = deviceId
+		if err = s.insertSigner(tx, &signer); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE devices SET key_id = ?, key_created_at = ?, key_handle = ? WHERE id = ?",
+			signer.ID, nullTime(signer.CreatedAt), signer.KeyHandle, deviceId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &signer, nil
+}
+
+func (s *SQLiteStorage) GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error) {
+	if _, err := s.FindByID(deviceId); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT `+signerColumns+`
+		FROM device_keys WHERE device_id = ? ORDER BY version`, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSigners(rows)
+}
+
+func (s *SQLiteStorage) insertSigner(tx *sql.Tx, signer *domain.DeviceSigner) error {
+	_, err := tx.Exec(`INSERT INTO device_keys (`+signerColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		signer.ID, signer.DeviceId, signer.Version, nullTime(signer.CreatedAt), signer.AlgorithmType,
+		signer.Options.Curve, signer.Options.KeySize, signer.Options.Padding, signer.KeyHandle)
+	return err
+}
@@ -0,0 +1,69 @@
+package persistence
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+func newSQLiteTestStorage(t *testing.T, path string) *SQLiteStorage {
+	store, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return newSQLiteTestStorage(t, filepath.Join(t.TempDir(), "signservice.db"))
+	})
+}
+
+func TestSQLiteConcurrentCounter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signservice.db")
+	first := newSQLiteTestStorage(t, path)
+	second := newSQLiteTestStorage(t, path)
+
+	testConcurrentCounter(t, []Storage{first, second})
+}
+
+func TestSQLiteStorageReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signservice.db")
+	store := newSQLiteTestStorage(t, path)
+	assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC}))
+	appendTestSigning(t, store)
+	assert.NoError(t, store.Close())
+
+	// migrations are not applied twice and the data survives the restart
+	reopened := newSQLiteTestStorage(t, path)
+	device, err := reopened.FindByID("device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), device.Counter)
+	chain, err := reopened.GetSigningChain("device-1")
+	assert.NoError(t, err)
+	assert.Len(t, chain, 1)
+	assert.Equal(t, "sig-1", chain[0].Signature)
+}
+
+func TestSQLiteStoragePathEscaping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sign?service#1%20.db")
+	store := newSQLiteTestStorage(t, path)
+	assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC}))
+	assert.NoError(t, store.Close())
+
+	// the database is the named file and the options after the path still apply
+	assert.FileExists(t, path)
+	reopened := newSQLiteTestStorage(t, path)
+	_, err := reopened.FindByID("device-1")
+	assert.NoError(t, err)
+	var journalMode string
+	assert.NoError(t, reopened.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+}
@@ -0,0 +1,232 @@
+package persistence
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// Storage is the set of operations a storage backend has to provide to serve the device and the sign repositories.
+type Storage interface {
+	Save(device domain.Device) error
+	FindByID(id string) (*domain.Device, error)
+	// GetAll returns a page of the devices passing the filter in its sort order, by creation time by default, and the
+	// number of devices passing it.
+	GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error)
+	// GetDevicesPage returns up to pageSize devices passing the filter after the cursor, before it when it is backward,
+	// ordered by creation time, then id, and whether more are left in that direction. A nil cursor starts at the first
+	// device. The sort of the filter is ignored.
+	GetDevicesPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error)
+	// UpdateDeviceState moves the device from state from to state to and fails when it is no longer in from.
+	// It waits for a signing of the device in progress, so nothing is signed once the device left the active state,
+	// and only then reads the time of the change from clock.
+	UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error
+	// UpdateDeviceDetails replaces the label and the metadata of the device and advances its version, it fails with
+	// services.CodeDeviceModified when the device is no longer at version.
+	UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error
+	// RotateDeviceKey stores signer with the next version of the device and makes it the active key. It waits for a
+	// signing of the device in progress, so every signing records the key it was really signed with, and fails with
+	// services.CodeDeviceDecommissioned when the device is decommissioned by then.
+	RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error)
+	// GetDeviceSigners returns every key of the device, oldest first.
+	GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error)
+
+	// GetAllSignings returns a page of the signings of the device ordered by counter and the number of signings, a page
+	// past the end is empty. An unknown device is not found.
+	GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error)
+	// GetSigningsPage is GetDevicesPage for the signings of the device, the cursor positions on the counter.
+	GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) ([]*domain.Signings, bool, error)
+	GetSigningChain(deviceId string) ([]*domain.Signings, error)
+	// GetSigningByCounter returns the signing of the device with the given counter.
+	GetSigningByCounter(deviceId string, counter int64) (*domain.Signings, error)
+	// GetSigningByID returns the signing with the given id.
+	GetSigningByID(id string) (*domain.Signings, error)
+	// AppendSigning reads the last counter and signature of the device, calls sign with the next counter and the active
+	// key and stores the result with details, atomically: concurrent calls for the same device, from this or any other instance, queue up behind it.
+	// Nothing is stored when sign fails.
+	AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error)
+}
+
+// storedDevice fills in what a device is stored with when the caller left it out: devices start active at version 1,
+// without metadata rather than with an empty one and, like the devices stored before keys could be rotated, use their
+// key handle as key id when they have none. The creation time is kept in milliseconds, the precision sqlite stores,
+// so every storage orders and pages through the same values. The counter is never taken from the caller, it counts the
+// signings appended afterwards.
+func storedDevice(device domain.Device) domain.Device {
+	device.Counter = 0
+	if !device.CreatedAt.IsZero() {
+		device.CreatedAt = device.CreatedAt.UTC().Truncate(time.Millisecond)
+	}
+	if device.State == "" {
+		device.State = domain.DeviceStateActive
+	}
+	if device.Version == 0 {
+		device.Version = 1
+	}
+	if len(device.Metadata) == 0 {
+		device.Metadata = nil
+	}
+	if device.KeyID == "" {
+		device.KeyID = device.KeyHandle
+	}
+	return device
+}
+
+// initialSigner is the first key of a device, the one it was stored with.
+func initialSigner(device domain.Device) *domain.DeviceSigner {
+	return &domain.DeviceSigner{
+		ID:            device.KeyID,
+		DeviceId:      device.ID,
+		Version:       1,
+		CreatedAt:     device.KeyCreatedAt,
+		AlgorithmType: device.AlgorithmType,
+		Options:       device.Options,
+		KeyHandle:     device.KeyHandle,
+	}
+}
+
+// newSigning is the signing stored for counter: signed by the active key of the device, with the details of the caller.
+func newSigning(device *domain.Device, counter int64, signature, signedData string, details domain.SigningDetails) *domain.Signings {
+	signing := &domain.Signings{
+		ID:         uuid.New().String(),
+		DeviceId:   device.ID,
+		Counter:    counter,
+		Signature:  signature,
+		SignedData: signedData,
+		KeyID:      device.KeyID,
+		Algorithm:  device.AlgorithmType,
+	}
+	if details.Clock != nil {
+		signing.CreatedAt = details.Clock()
+	}
+	if len(details.Metadata) > 0 {
+		signing.Metadata = details.Metadata
+	}
+	return signing
+}
+
+// compareDevice orders the device against the cursor, devices are listed by creation time, then id.
+func compareDevice(device *domain.Device, cursor *domain.PageCursor) int {
+	switch {
+	case device.CreatedAt.Before(cursor.CreatedAt):
+		return -1
+	case device.CreatedAt.After(cursor.CreatedAt):
+		return 1
+	}
+	return strings.Compare(device.ID, cursor.ID)
+}
+
+// matchesDevice reports whether the device passes the filter.
+func matchesDevice(device *domain.Device, filter domain.DeviceFilter) bool {
+	switch {
+	case filter.Algorithm != "" && device.AlgorithmType != filter.Algorithm,
+		filter.State != "" && device.State != filter.State,
+		!filter.CreatedFrom.IsZero() && device.CreatedAt.Before(filter.CreatedFrom),
+		!filter.CreatedTo.IsZero() && !device.CreatedAt.Before(filter.CreatedTo),
+		filter.MinCounter != nil && device.Counter < *filter.MinCounter,
+		filter.MaxCounter != nil && device.Counter > *filter.MaxCounter:
+		return false
+	}
+	if filter.Label == "" {
+		return true
+	}
+	return device.Label != nil && strings.Contains(strings.ToLower(*device.Label), strings.ToLower(filter.Label))
+}
+
+// deviceLess reports whether device a is listed before device b in the sort of the filter, ties are broken by id.
+func deviceLess(a, b *domain.Device, filter domain.DeviceFilter) bool {
+	if filter.Descending {
+		a, b = b, a
+	}
+	var order int
+	switch filter.Sort {
+	case domain.DeviceSortID:
+	case domain.DeviceSortLabel:
+		order = strings.Compare(labelOf(a), labelOf(b))
+	case domain.DeviceSortCounter:
+		order = compareInt(a.Counter, b.Counter)
+	default:
+		order = compareDevice(a, &domain.PageCursor{CreatedAt: b.CreatedAt, ID: b.ID})
+	}
+	if order == 0 {
+		order = strings.Compare(a.ID, b.ID)
+	}
+	return order < 0
+}
+
+// labelOf sorts devices without a label like those with an empty one.
+func labelOf(device *domain.Device) string {
+	if device.Label == nil {
+		return ""
+	}
+	return *device.Label
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareSigning orders the signing against the cursor, signings are listed by counter.
+func compareSigning(signing *domain.Signings, cursor *domain.PageCursor) int {
+	return compareInt(signing.Counter, cursor.Counter)
+}
+
+// cursorPage cuts the page of up to pageSize items next to the cursor out of items, which are in listing order, and
+// reports whether more are left in its direction. compare orders an item against the cursor.
+func cursorPage[T any](items []*T, cursor *domain.PageCursor, pageSize int, compare func(*T, *domain.PageCursor) int) ([]*T, bool) {
+	if cursor == nil {
+		end := pageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		return items[:end], end < len(items)
+	}
+	if cursor.Backward {
+		end := sort.Search(len(items), func(i int) bool { return compare(items[i], cursor) >= 0 })
+		start := end - pageSize
+		if start < 0 {
+			start = 0
+		}
+		return items[start:end], start > 0
+	}
+	start := sort.Search(len(items), func(i int) bool { return compare(items[i], cursor) > 0 })
+	end := start + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end], end < len(items)
+}
+
+// pageOffset is the number of items before page pageNr, false when it doesn't fit an int. The services reject such
+// pages, a storage answers them like any other page past the end.
+func pageOffset(pageNr int, pageSize int) (int, bool) {
+	if pageNr < 1 || pageSize < 1 || pageNr-1 > math.MaxInt/pageSize {
+		return 0, false
+	}
+	return (pageNr - 1) * pageSize, true
+}
+
+// offsetPage returns page pageNr of pageSize items, pages past the end are empty.
+func offsetPage[T any](items []*T, pageNr int, pageSize int) []*T {
+	start, ok := pageOffset(pageNr, pageSize)
+	if !ok || start >= len(items) {
+		return []*T{}
+	}
+	end := start + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
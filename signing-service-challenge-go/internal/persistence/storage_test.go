@@ -0,0 +1,503 @@
+package persistence
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// testStorage runs the behaviour every Storage implementation has to share against a fresh, empty storage.
+func testStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("save and find devices", func(t *testing.T) {
+		store := newStorage(t)
+		label := "till 1"
+		device := domain.Device{
+			ID:            "device-1",
+			AlgorithmType: domain.AlgorithmTypeRSA,
+			Options:       domain.AlgorithmOptions{KeySize: 2048, Padding: domain.PaddingTypePSS},
+			Label:         &label,
+			Metadata:      map[string]string{"store": "berlin-1"},
+			Version:       1,
+			CreatedAt:     time.Date(2024, 3, 1, 12, 30, 0, 123000000, time.UTC),
+			State:         domain.DeviceStateActive,
+			KeyID:         "key-1",
+			KeyHandle:     "handle-1",
+		}
+		assert.NoError(t, store.Save(device))
+		assert.ErrorIs(t, store.Save(device), domain.ErrDeviceExists, "duplicated ids must be rejected")
+
+		found, err := store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, device, *found)
+
+		_, err = store.FindByID("unknown")
+		var notFound *services.ServiceError
+		if assert.ErrorAs(t, err, &notFound) {
+			assert.Equal(t, services.CodeDeviceNotFound, notFound.Code)
+		}
+	})
+
+	t.Run("page through devices", func(t *testing.T) {
+		store := newStorage(t)
+		// ids don't follow the creation order, devices created in the same millisecond are ordered by id
+		created := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+		var expectedOrder []string
+		for i := 0; i < 25; i++ {
+			id := strconv.Itoa(24 - i)
+			createdAt := created.Add(time.Duration(i/2) * time.Minute)
+			assert.NoError(t, store.Save(domain.Device{ID: id, AlgorithmType: domain.AlgorithmTypeECC, CreatedAt: createdAt}))
+			expectedOrder = append(expectedOrder, id)
+		}
+		for i := 0; i+1 < len(expectedOrder); i += 2 {
+			if expectedOrder[i] > expectedOrder[i+1] {
+				expectedOrder[i], expectedOrder[i+1] = expectedOrder[i+1], expectedOrder[i]
+			}
+		}
+
+		var listed []string
+		for page, expected := range []int{10, 10, 5, 0} {
+			devices, total, err := store.GetAll(domain.DeviceFilter{}, page+1, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, 25, total)
+			assert.Len(t, devices, expected)
+			for _, device := range devices {
+				listed = append(listed, device.ID)
+			}
+		}
+		assert.Equal(t, expectedOrder, listed, "devices are listed by creation time, then id")
+		devices, total, err := store.GetAll(domain.DeviceFilter{}, math.MaxInt/10+2, 10)
+		assert.NoError(t, err, "pages whose offset overflows are past the end")
+		assert.Equal(t, 25, total)
+		assert.Empty(t, devices)
+
+		listed = nil
+		var cursor *domain.PageCursor
+		for {
+			devices, more, err := store.GetDevicesPage(domain.DeviceFilter{}, cursor, 10)
+			assert.NoError(t, err)
+			for _, device := range devices {
+				listed = append(listed, device.ID)
+			}
+			if !more {
+				break
+			}
+			last := devices[len(devices)-1]
+			cursor = &domain.PageCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		}
+		assert.Equal(t, expectedOrder, listed, "cursor pages list the devices like GetAll")
+
+		cursor.Backward = true
+		devices, more, err := store.GetDevicesPage(domain.DeviceFilter{}, cursor, 3)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		if assert.Len(t, devices, 3) {
+			assert.Equal(t, expectedOrder[16:19], []string{devices[0].ID, devices[1].ID, devices[2].ID})
+		}
+		devices, more, err = store.GetDevicesPage(domain.DeviceFilter{}, &domain.PageCursor{CreatedAt: devices[0].CreatedAt, ID: devices[0].ID, Backward: true}, 20)
+		assert.NoError(t, err)
+		assert.False(t, more)
+		assert.Len(t, devices, 16)
+	})
+
+	t.Run("filter and sort devices", func(t *testing.T) {
+		store := newStorage(t)
+		created := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+		label := func(label string) *string { return &label }
+		for i, device := range []domain.Device{
+			{ID: "a", AlgorithmType: domain.AlgorithmTypeRSA, Label: label("Store-42 till 1")},
+			{ID: "b", AlgorithmType: domain.AlgorithmTypeRSA, Label: label("store-42 till 2")},
+			{ID: "c", AlgorithmType: domain.AlgorithmTypeECC, Label: label("Store-420"), State: domain.DeviceStateSuspended},
+			{ID: "d", AlgorithmType: domain.AlgorithmTypeEd25519},
+			{ID: "e", AlgorithmType: domain.AlgorithmTypeRSA, Label: label("Store_42")},
+		} {
+			device.CreatedAt = created.Add(time.Duration(i) * time.Hour)
+			assert.NoError(t, store.Save(device))
+		}
+		for id, signings := range map[string]int{"b": 3, "d": 5} {
+			for i := 0; i < signings; i++ {
+				_, err := store.AppendSigning(id, domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+					return "sig-" + strconv.FormatInt(counter, 10), "data", nil
+				})
+				assert.NoError(t, err)
+			}
+		}
+
+		zero, one := int64(0), int64(1)
+		tests := []struct {
+			name     string
+			filter   domain.DeviceFilter
+			expected []string
+		}{
+			{name: "no filter", expected: []string{"a", "b", "c", "d", "e"}},
+			{name: "RSA without signings", filter: domain.DeviceFilter{Algorithm: domain.AlgorithmTypeRSA, MaxCounter: &zero}, expected: []string{"a", "e"}},
+			{name: "label ignoring case", filter: domain.DeviceFilter{Label: "STORE-42"}, expected: []string{"a", "b", "c"}},
+			{name: "label wildcards match themselves", filter: domain.DeviceFilter{Label: "_42"}, expected: []string{"e"}},
+			{name: "state", filter: domain.DeviceFilter{State: domain.DeviceStateSuspended}, expected: []string{"c"}},
+			{name: "creation range", filter: domain.DeviceFilter{CreatedFrom: created.Add(time.Hour), CreatedTo: created.Add(3 * time.Hour)}, expected: []string{"b", "c"}},
+			{name: "signed devices", filter: domain.DeviceFilter{MinCounter: &one}, expected: []string{"b", "d"}},
+			{name: "by counter descending", filter: domain.DeviceFilter{Sort: domain.DeviceSortCounter, Descending: true}, expected: []string{"d", "b", "e", "c", "a"}},
+			{name: "by label", filter: domain.DeviceFilter{Sort: domain.DeviceSortLabel}, expected: []string{"d", "a", "c", "e", "b"}},
+			{name: "by id descending", filter: domain.DeviceFilter{Sort: domain.DeviceSortID, Descending: true}, expected: []string{"e", "d", "c", "b", "a"}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				devices, total, err := store.GetAll(test.filter, 1, 10)
+				assert.NoError(t, err)
+				assert.Equal(t, len(test.expected), total)
+				var ids []string
+				for _, device := range devices {
+					ids = append(ids, device.ID)
+				}
+				assert.Equal(t, test.expected, ids)
+			})
+		}
+
+		// cursor pages apply the filter too
+		filter := domain.DeviceFilter{Algorithm: domain.AlgorithmTypeRSA}
+		devices, more, err := store.GetDevicesPage(filter, nil, 2)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		if assert.Len(t, devices, 2) {
+			devices, more, err = store.GetDevicesPage(filter, &domain.PageCursor{CreatedAt: devices[1].CreatedAt, ID: devices[1].ID}, 2)
+			assert.NoError(t, err)
+			assert.False(t, more)
+			if assert.Len(t, devices, 1) {
+				assert.Equal(t, "e", devices[0].ID)
+			}
+		}
+	})
+
+	t.Run("counter sent by the caller", func(t *testing.T) {
+		store := newStorage(t)
+		assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC, Counter: 5}))
+
+		device, err := store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), device.Counter, "the counter counts the signings")
+
+		signing, err := store.AppendSigning("device-1", domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+			assert.Equal(t, int64(1), counter)
+			assert.Equal(t, "", lastSignature)
+			return "sig-1", "data", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), signing.Counter)
+		device, err = store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), device.Counter)
+	})
+
+	t.Run("sign chain", func(t *testing.T) {
+		store := newStorage(t)
+		assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC}))
+
+		for i := int64(1); i <= 5; i++ {
+			signing, err := store.AppendSigning("device-1", domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+				assert.Equal(t, i, counter)
+				if i == 1 {
+					assert.Equal(t, "", lastSignature)
+				} else {
+					assert.Equal(t, "sig-"+strconv.FormatInt(i-1, 10), lastSignature)
+				}
+				return "sig-" + strconv.FormatInt(counter, 10), "data", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, i, signing.Counter)
+			assert.Equal(t, "device-1", signing.DeviceId)
+		}
+
+		_, err := store.AppendSigning("device-1", domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+			return "", "", errors.New("key store unavailable")
+		})
+		assert.Error(t, err, "failed signings are not stored")
+
+		createdAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+		details := domain.SigningDetails{Clock: func() time.Time { return createdAt }, Metadata: map[string]string{"receipt": "R-6"}}
+		detailed, err := store.AppendSigning("device-1", details, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+			return "sig-6", "data", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, domain.AlgorithmTypeECC, detailed.Algorithm)
+		assert.True(t, createdAt.Equal(detailed.CreatedAt))
+		assert.Equal(t, details.Metadata, detailed.Metadata)
+		stored, err := store.GetSigningByID(detailed.ID)
+		assert.NoError(t, err)
+		assert.True(t, createdAt.Equal(stored.CreatedAt), "the creation time is stored")
+		assert.Equal(t, details.Metadata, stored.Metadata)
+		assert.Equal(t, domain.AlgorithmTypeECC, stored.Algorithm)
+
+		device, err := store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6), device.Counter)
+
+		chain, err := store.GetSigningChain("device-1")
+		assert.NoError(t, err)
+		assert.Len(t, chain, 6)
+		for i, signing := range chain {
+			assert.Equal(t, int64(i+1), signing.Counter)
+		}
+
+		found, err := store.GetSigningByCounter("device-1", 3)
+		assert.NoError(t, err)
+		assert.Equal(t, chain[2], found)
+		found, err = store.GetSigningByID(chain[3].ID)
+		assert.NoError(t, err)
+		assert.Equal(t, chain[3], found)
+		var notFound *services.ServiceError
+		for _, counter := range []int64{0, 7} {
+			_, err = store.GetSigningByCounter("device-1", counter)
+			if assert.ErrorAs(t, err, &notFound) {
+				assert.Equal(t, services.CodeSigningNotFound, notFound.Code)
+			}
+		}
+		_, err = store.GetSigningByCounter("unknown", 1)
+		if assert.ErrorAs(t, err, &notFound) {
+			assert.Equal(t, services.CodeDeviceNotFound, notFound.Code)
+		}
+		// ids that aren't UUIDs are not found either, the postgres column only takes UUIDs
+		for _, id := range []string{"unknown", "7a1c3d0e-52f4-4c3b-9a8e-2f1b6c0d9e47"} {
+			_, err = store.GetSigningByID(id)
+			if assert.ErrorAs(t, err, &notFound) {
+				assert.Equal(t, services.CodeSigningNotFound, notFound.Code)
+			}
+		}
+
+		signings, total, err := store.GetAllSignings("device-1", 2, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 6, total)
+		assert.Equal(t, int64(3), signings[0].Counter)
+		assert.Equal(t, int64(4), signings[1].Counter)
+
+		signings, total, err = store.GetAllSignings("device-1", 4, 2)
+		assert.NoError(t, err, "pages past the end are empty")
+		assert.Equal(t, 6, total)
+		assert.Empty(t, signings)
+		signings, total, err = store.GetAllSignings("device-1", math.MaxInt/2+2, 2)
+		assert.NoError(t, err, "pages whose offset overflows are past the end too")
+		assert.Equal(t, 6, total)
+		assert.Empty(t, signings)
+		assert.NoError(t, store.Save(domain.Device{ID: "device-2", AlgorithmType: domain.AlgorithmTypeECC}))
+		signings, total, err = store.GetAllSignings("device-2", 1, 2)
+		assert.NoError(t, err, "a device without signings is listed empty")
+		assert.Zero(t, total)
+		assert.Empty(t, signings)
+		_, _, err = store.GetAllSignings("unknown", 1, 2)
+		if assert.ErrorAs(t, err, &notFound) {
+			assert.Equal(t, services.CodeDeviceNotFound, notFound.Code)
+		}
+
+		signings, more, err := store.GetSigningsPage("device-1", nil, 4)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		assert.Equal(t, chain[:4], signings)
+		signings, more, err = store.GetSigningsPage("device-1", &domain.PageCursor{Counter: 4}, 4)
+		assert.NoError(t, err)
+		assert.False(t, more)
+		assert.Equal(t, chain[4:], signings)
+		signings, more, err = store.GetSigningsPage("device-1", &domain.PageCursor{Counter: 4, Backward: true}, 2)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		assert.Equal(t, chain[1:3], signings)
+		_, _, err = store.GetSigningsPage("unknown", nil, 4)
+		if assert.ErrorAs(t, err, &notFound) {
+			assert.Equal(t, services.CodeDeviceNotFound, notFound.Code)
+		}
+
+		_, err = store.AppendSigning("unknown", domain.SigningDetails{}, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+			t.Error("unknown devices must not be signed for")
+			return "", "", nil
+		})
+		assert.Error(t, err)
+		_, err = store.GetSigningChain("unknown")
+		assert.Error(t, err)
+	})
+
+	t.Run("update details", func(t *testing.T) {
+		store := newStorage(t)
+		assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC}))
+
+		device, err := store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), device.Version, "devices start at version 1")
+		assert.Nil(t, device.Metadata)
+
+		label := "till 2"
+		assert.NoError(t, store.UpdateDeviceDetails("device-1", 1, &label, map[string]string{"store": "berlin-1"}))
+		err = store.UpdateDeviceDetails("device-1", 1, nil, nil)
+		var serviceError *services.ServiceError
+		if assert.ErrorAs(t, err, &serviceError) {
+			assert.Equal(t, services.CodeDeviceModified, serviceError.Code)
+			assert.Equal(t, services.ErrorKindPreconditionFailed, serviceError.Kind)
+		}
+		err = store.UpdateDeviceDetails("unknown", 1, nil, nil)
+		if assert.ErrorAs(t, err, &serviceError) {
+			assert.Equal(t, services.CodeDeviceNotFound, serviceError.Code)
+		}
+
+		device, err = store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), device.Version)
+		assert.Equal(t, "till 2", *device.Label)
+		assert.Equal(t, map[string]string{"store": "berlin-1"}, device.Metadata)
+
+		assert.NoError(t, store.UpdateDeviceDetails("device-1", 2, nil, map[string]string{}))
+		device, err = store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), device.Version)
+		assert.Nil(t, device.Label)
+		assert.Nil(t, device.Metadata)
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		store := newStorage(t)
+		createdAt := time.Now().UTC().Truncate(time.Microsecond)
+		assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC, Options: domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+			KeyID: "key-1", KeyCreatedAt: createdAt, KeyHandle: "handle-1"}))
+		sign := func(expectedHandle string) domain.SignFunc {
+			return func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+				assert.Equal(t, expectedHandle, keyHandle)
+				return "sig-" + strconv.FormatInt(counter, 10), "data", nil
+			}
+		}
+
+		signing, err := store.AppendSigning("device-1", domain.SigningDetails{}, sign("handle-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "key-1", signing.KeyID)
+
+		rotatedAt := createdAt.Add(time.Hour)
+		rotated, err := store.RotateDeviceKey("device-1", domain.DeviceSigner{ID: "key-2", CreatedAt: rotatedAt,
+			AlgorithmType: domain.AlgorithmTypeECC, Options: domain.AlgorithmOptions{Curve: domain.CurveTypeP256}, KeyHandle: "handle-2"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, rotated.Version)
+		assert.Equal(t, "device-1", rotated.DeviceId)
+		_, err = store.RotateDeviceKey("unknown", domain.DeviceSigner{ID: "key-3", KeyHandle: "handle-3"})
+		assert.Error(t, err)
+
+		device, err := store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, "key-2", device.KeyID)
+		assert.Equal(t, "handle-2", device.KeyHandle)
+		assert.True(t, rotatedAt.Equal(device.KeyCreatedAt))
+
+		signing, err = store.AppendSigning("device-1", domain.SigningDetails{}, sign("handle-2"))
+		assert.NoError(t, err)
+		assert.Equal(t, "key-2", signing.KeyID)
+
+		chain, err := store.GetSigningChain("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, "key-1", chain[0].KeyID, "older signings keep the key they were signed with")
+		assert.Equal(t, "key-2", chain[1].KeyID)
+
+		signers, err := store.GetDeviceSigners("device-1")
+		assert.NoError(t, err)
+		assert.Len(t, signers, 2)
+		assert.Equal(t, "key-1", signers[0].ID)
+		assert.Equal(t, 1, signers[0].Version)
+		assert.Equal(t, "handle-1", signers[0].KeyHandle)
+		assert.Equal(t, domain.CurveTypeP256, signers[0].Options.Curve)
+		assert.True(t, createdAt.Equal(signers[0].CreatedAt))
+		assert.Equal(t, "key-2", signers[1].ID)
+		assert.Equal(t, 2, signers[1].Version)
+
+		_, err = store.GetDeviceSigners("unknown")
+		assert.Error(t, err)
+
+		assert.NoError(t, store.UpdateDeviceState("device-1", domain.DeviceStateActive, domain.DeviceStateDecommissioned, services.SystemClock))
+		_, err = store.RotateDeviceKey("device-1", domain.DeviceSigner{ID: "key-3", KeyHandle: "handle-3"})
+		var serviceError *services.ServiceError
+		if assert.ErrorAs(t, err, &serviceError, "decommissioned devices get no new keys") {
+			assert.Equal(t, services.CodeDeviceDecommissioned, serviceError.Code)
+		}
+		signers, err = store.GetDeviceSigners("device-1")
+		assert.NoError(t, err)
+		assert.Len(t, signers, 2)
+	})
+
+	t.Run("device state", func(t *testing.T) {
+		store := newStorage(t)
+		assert.NoError(t, store.Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC}))
+		sign := func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+			return "sig", "data", nil
+		}
+
+		device, err := store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, domain.DeviceStateActive, device.State, "devices start active")
+		assert.True(t, device.StateChangedAt.IsZero())
+
+		suspendedAt := time.Now().UTC().Truncate(time.Microsecond)
+		clock := func() time.Time { return suspendedAt }
+		assert.NoError(t, store.UpdateDeviceState("device-1", domain.DeviceStateActive, domain.DeviceStateSuspended, clock))
+		err = store.UpdateDeviceState("device-1", domain.DeviceStateActive, domain.DeviceStateDecommissioned, clock)
+		var serviceError *services.ServiceError
+		if assert.ErrorAs(t, err, &serviceError, "the device is no longer active") {
+			assert.Equal(t, services.CodeDeviceModified, serviceError.Code)
+		}
+		err = store.UpdateDeviceState("unknown", domain.DeviceStateActive, domain.DeviceStateSuspended, clock)
+		if assert.ErrorAs(t, err, &serviceError) {
+			assert.Equal(t, services.CodeDeviceNotFound, serviceError.Code)
+		}
+
+		device, err = store.FindByID("device-1")
+		assert.NoError(t, err)
+		assert.Equal(t, domain.DeviceStateSuspended, device.State)
+		assert.True(t, suspendedAt.Equal(device.StateChangedAt))
+
+		_, err = store.AppendSigning("device-1", domain.SigningDetails{}, sign)
+		var notActive *domain.DeviceNotActiveError
+		assert.ErrorAs(t, err, &notActive)
+
+		assert.NoError(t, store.UpdateDeviceState("device-1", domain.DeviceStateSuspended, domain.DeviceStateActive, services.SystemClock))
+		_, err = store.AppendSigning("device-1", domain.SigningDetails{}, sign)
+		assert.NoError(t, err)
+	})
+}
+
+// testConcurrentCounter checks that storages shared by several service instances keep the counter gapless:
+// every instance appends signings at the same time and each one has to be chained to the one before it.
+// The clock ticks on every reading, the creation times have to follow the counters.
+func testConcurrentCounter(t *testing.T, instances []Storage) {
+	assert.NoError(t, instances[0].Save(domain.Device{ID: "device-1", AlgorithmType: domain.AlgorithmTypeECC}))
+	start := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	var ticks atomic.Int64
+	details := domain.SigningDetails{Clock: func() time.Time {
+		return start.Add(time.Duration(ticks.Add(1)) * time.Millisecond)
+	}}
+
+	const signingsPerInstance = 20
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(store Storage) {
+			defer wg.Done()
+			for i := 0; i < signingsPerInstance; i++ {
+				_, err := store.AppendSigning("device-1", details, func(counter int64, lastSignature string, keyHandle string) (string, string, error) {
+					return "sig-" + strconv.FormatInt(counter, 10), lastSignature, nil
+				})
+				assert.NoError(t, err)
+			}
+		}(instance)
+	}
+	wg.Wait()
+
+	chain, err := instances[0].GetSigningChain("device-1")
+	assert.NoError(t, err)
+	assert.Len(t, chain, signingsPerInstance*len(instances))
+	for i, signing := range chain {
+		assert.Equal(t, int64(i+1), signing.Counter)
+		if i > 0 {
+			// the signed data carries the last signature the callback was given
+			assert.Equal(t, chain[i-1].Signature, signing.SignedData)
+			assert.True(t, chain[i-1].CreatedAt.Before(signing.CreatedAt), "signing %d is older than the one before it", signing.Counter)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package services
+
+import "time"
+
+// Clock returns the current time, services take one so tests can fix the time they record.
+type Clock func() time.Time
+
+// SystemClock is the Clock of the running service, it reports UTC.
+func SystemClock() time.Time {
+	return time.Now().UTC()
+}
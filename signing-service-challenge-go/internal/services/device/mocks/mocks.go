@@ -2,6 +2,7 @@ package mocks
 
 import (
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -22,7 +23,39 @@ func (m *MockDeviceRepository) FindByID(id string) (*domain.Device, error) {
 	return args.Get(0).(*domain.Device), args.Error(1)
 }
 
-func (m *MockDeviceRepository) GetAll(pageNr int, pageSize int) ([]*domain.Device, int, error) {
-	args := m.Called(pageNr, pageSize)
+func (m *MockDeviceRepository) GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error) {
+	args := m.Called(filter, pageNr, pageSize)
 	return args.Get(0).([]*domain.Device), args.Int(1), args.Error(2)
 }
+
+func (m *MockDeviceRepository) GetDevicesPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error) {
+	args := m.Called(filter, cursor, pageSize)
+	return args.Get(0).([]*domain.Device), args.Bool(1), args.Error(2)
+}
+
+// UpdateDeviceState reads the clock like a real repository would, so tests can match the time of the change.
+func (m *MockDeviceRepository) UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error {
+	args := m.Called(id, from, to, clock())
+	return args.Error(0)
+}
+
+func (m *MockDeviceRepository) RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error) {
+	args := m.Called(deviceId, signer)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.DeviceSigner), args.Error(1)
+}
+
+func (m *MockDeviceRepository) GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error) {
+	args := m.Called(deviceId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*domain.DeviceSigner), args.Error(1)
+}
+
+func (m *MockDeviceRepository) UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error {
+	args := m.Called(id, version, label, metadata)
+	return args.Error(0)
+}
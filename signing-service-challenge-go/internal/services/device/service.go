@@ -1,8 +1,12 @@
 package device
 
 import (
+	"errors"
 	"fmt"
-	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
@@ -12,37 +16,158 @@ import (
 type DeviceService interface {
 	GetById(id string) (*domain.Device, error)
 	Save(input *domain.Device) error
-	GetAll(pageNr int, pageSize int) ([]*domain.Device, int, error)
+	GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error)
+	GetPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) (*domain.CursorPage[domain.Device], error)
+	GetPublicKey(id string, keyID string) (crypto.Verifier, string, error)
+	UpdateState(id string, state domain.DeviceState) (*domain.Device, error)
+	UpdateDetails(id string, version *int64, patch DevicePatch) (*domain.Device, error)
+	RotateKey(id string) (*domain.DeviceSigner, error)
+	GetKeys(id string) ([]*domain.DeviceSigner, error)
 }
 
 type DeviceRepository interface {
 	Save(device domain.Device) error
 	FindByID(id string) (*domain.Device, error)
-	GetAll(pageNr int, pageSize int) ([]*domain.Device, int, error)
+	GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error)
+	GetDevicesPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) ([]*domain.Device, bool, error)
+	UpdateDeviceState(id string, from, to domain.DeviceState, clock services.Clock) error
+	UpdateDeviceDetails(id string, version int64, label *string, metadata map[string]string) error
+	RotateDeviceKey(deviceId string, signer domain.DeviceSigner) (*domain.DeviceSigner, error)
+	GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error)
+}
+
+type KeyStore interface {
+	Generate(algorithm domain.AlgorithmType, options domain.AlgorithmOptions) (string, error)
+	PublicKey(handle string) (crypto.Verifier, error)
+	Destroy(handle string) error
+}
+
+// keyEvicter is implemented by key stores caching decoded keys, the key of a device that stops signing
+// and the keys replaced by a rotation are dropped.
+type keyEvicter interface {
+	Evict(handle string)
+}
+
+// allowedTransitions lists the states a device can move to from each state. Decommissioning is final,
+// a retired device never signs again.
+var allowedTransitions = map[domain.DeviceState][]domain.DeviceState{
+	domain.DeviceStateActive:    {domain.DeviceStateSuspended, domain.DeviceStateDecommissioned},
+	domain.DeviceStateSuspended: {domain.DeviceStateActive, domain.DeviceStateDecommissioned},
+}
+
+// minimumRSAKeySize is the smallest RSA modulus accepted by our security review.
+const minimumRSAKeySize = 2048
+
+// IDPolicy decides which client supplied device ids are accepted. Ids end up in URL paths, so they are never free text.
+type IDPolicy string
+
+const (
+	// IDPolicySafe accepts ids of up to maxDeviceIDLength letters, digits, '-' and '_', it is the default
+	IDPolicySafe IDPolicy = "safe"
+	// IDPolicyUUID only accepts UUIDs in their canonical form
+	IDPolicyUUID IDPolicy = "uuid"
+)
+
+const maxDeviceIDLength = 64
+
+// ParseIDPolicy returns the policy named by value, an empty value is IDPolicySafe.
+func ParseIDPolicy(value string) (IDPolicy, error) {
+	switch IDPolicy(value) {
+	case "", IDPolicySafe:
+		return IDPolicySafe, nil
+	case IDPolicyUUID:
+		return IDPolicyUUID, nil
+	default:
+		return "", fmt.Errorf("unknown device id policy %q, it must be one of safe or uuid", value)
+	}
 }
 
-type CryptoFactory interface {
-	CreateMarshaller(input domain.AlgorithmType) (crypto.AlgorithmMarshaller, error)
-	GenerateAlgorithm(input domain.AlgorithmType) (crypto.Signer, error)
+// DevicePatch holds the changes of a JSON merge patch (RFC 7396) to the editable fields of a device.
+type DevicePatch struct {
+	// SetLabel replaces the label with Label, a nil Label removes it
+	SetLabel bool
+	Label    *string
+	// ClearMetadata drops the current metadata before Metadata is merged into it, a nil value removes its key
+	ClearMetadata bool
+	Metadata      map[string]*string
 }
 
 type SignatureDeviceServiceImpl struct {
 	repository DeviceRepository
-	factory    CryptoFactory
+	keyStore   KeyStore
+	idPolicy   IDPolicy
+	clock      services.Clock
 }
 
-func NewDeviceService(repository DeviceRepository, factory CryptoFactory) *SignatureDeviceServiceImpl {
+func NewDeviceService(repository DeviceRepository, keyStore KeyStore, idPolicy IDPolicy, clock services.Clock) *SignatureDeviceServiceImpl {
 	return &SignatureDeviceServiceImpl{
 		repository: repository,
-		factory:    factory,
+		keyStore:   keyStore,
+		idPolicy:   idPolicy,
+		clock:      clock,
 	}
 }
 
-func (s *SignatureDeviceServiceImpl) GetAll(pageNr int, pageSize int) ([]*domain.Device, int, error) {
+// GetAll returns a page of the devices passing the filter in its sort order.
+func (s *SignatureDeviceServiceImpl) GetAll(filter domain.DeviceFilter, pageNr int, pageSize int) ([]*domain.Device, int, error) {
 	if pageNr < 1 || pageSize < 1 {
-		return nil, 0, services.NewServiceError("invalid page number or page size", http.StatusBadRequest)
+		return nil, 0, services.NewValidationError(services.CodeInvalidPage, "invalid page number or page size")
+	}
+	if err := services.ValidatePageOffset(pageNr, pageSize); err != nil {
+		return nil, 0, err
+	}
+	if err := validateFilter(filter); err != nil {
+		return nil, 0, err
+	}
+	return s.repository.GetAll(filter, pageNr, pageSize)
+}
+
+// GetPage returns the devices passing the filter next to the cursor, oldest first, a nil cursor starts at the first
+// device. Cursors follow the creation order, so the filter can't sort differently.
+func (s *SignatureDeviceServiceImpl) GetPage(filter domain.DeviceFilter, cursor *domain.PageCursor, pageSize int) (*domain.CursorPage[domain.Device], error) {
+	if pageSize < 1 {
+		return nil, services.NewValidationError(services.CodeInvalidPage, "invalid page size")
+	}
+	if err := validateFilter(filter); err != nil {
+		return nil, err
+	}
+	if (filter.Sort != "" && filter.Sort != domain.DeviceSortCreatedAt) || filter.Descending {
+		return nil, services.NewValidationError(services.CodeInvalidFilter, "pages by cursor are sorted by creation time, sort by pageNr instead")
+	}
+	devices, more, err := s.repository.GetDevicesPage(filter, cursor, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return services.NewCursorPage(devices, cursor, more, func(device *domain.Device) domain.PageCursor {
+		return domain.PageCursor{CreatedAt: device.CreatedAt, ID: device.ID}
+	}), nil
+}
+
+// validateFilter rejects filters on values a device can't have and empty ranges.
+func validateFilter(filter domain.DeviceFilter) error {
+	switch filter.Algorithm {
+	case domain.AlgorithmTypeUnknown, domain.AlgorithmTypeECC, domain.AlgorithmTypeRSA, domain.AlgorithmTypeEd25519:
+	default:
+		return services.NewValidationError(services.CodeInvalidFilter, fmt.Sprintf("unknown algorithm %q", filter.Algorithm))
+	}
+	if _, ok := domain.ConvertStringToDeviceState(string(filter.State)); filter.State != "" && !ok {
+		return services.NewValidationError(services.CodeInvalidFilter, fmt.Sprintf("unknown state %q", filter.State))
+	}
+	switch filter.Sort {
+	case "", domain.DeviceSortCreatedAt, domain.DeviceSortID, domain.DeviceSortLabel, domain.DeviceSortCounter:
+	default:
+		return services.NewValidationError(services.CodeInvalidFilter, fmt.Sprintf("devices can't be sorted by %q", filter.Sort))
 	}
-	return s.repository.GetAll(pageNr, pageSize)
+	if !filter.CreatedFrom.IsZero() && !filter.CreatedTo.IsZero() && !filter.CreatedFrom.Before(filter.CreatedTo) {
+		return services.NewValidationError(services.CodeInvalidFilter, "the creation range must end after it starts")
+	}
+	if (filter.MinCounter != nil && *filter.MinCounter < 0) || (filter.MaxCounter != nil && *filter.MaxCounter < 0) {
+		return services.NewValidationError(services.CodeInvalidFilter, "signature counters can't be negative")
+	}
+	if filter.MinCounter != nil && filter.MaxCounter != nil && *filter.MinCounter > *filter.MaxCounter {
+		return services.NewValidationError(services.CodeInvalidFilter, "the signature counter range must not end before it starts")
+	}
+	return nil
 }
 
 func (s *SignatureDeviceServiceImpl) GetById(id string) (*domain.Device, error) {
@@ -53,38 +178,303 @@ func (s *SignatureDeviceServiceImpl) GetById(id string) (*domain.Device, error)
 	return device, nil
 }
 
+// GetPublicKey returns the public key of the device from the key store, so it can be exported in the format the client
+// needs, together with its key id. It is the active key unless keyID names one of the older keys of the device. Both
+// come from the same read of the device, so a concurrent rotation can't pair a key with the id of another one.
+func (s *SignatureDeviceServiceImpl) GetPublicKey(id string, keyID string) (crypto.Verifier, string, error) {
+	device, err := s.GetById(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if device == nil {
+		return nil, "", services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+	if keyID == "" || keyID == device.KeyID {
+		verifier, err := s.keyStore.PublicKey(device.KeyHandle)
+		if err != nil {
+			return nil, "", err
+		}
+		return verifier, device.KeyID, nil
+	}
+
+	signers, err := s.repository.GetDeviceSigners(id)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, signer := range signers {
+		if signer.ID == keyID {
+			verifier, err := s.keyStore.PublicKey(signer.KeyHandle)
+			if err != nil {
+				return nil, "", err
+			}
+			return verifier, signer.ID, nil
+		}
+	}
+	return nil, "", services.NewNotFoundError(services.CodeKeyNotFound, "the device has no key with this id")
+}
+
+// GetKeys returns every key the device has had, oldest first. The last one is active.
+func (s *SignatureDeviceServiceImpl) GetKeys(id string) ([]*domain.DeviceSigner, error) {
+	return s.repository.GetDeviceSigners(id)
+}
+
+// RotateKey generates a new key pair for the device with the algorithm and options it was created with and makes it
+// the active key. The older keys stay in the key store so the signatures they made can still be verified.
+func (s *SignatureDeviceServiceImpl) RotateKey(id string) (*domain.DeviceSigner, error) {
+	device, err := s.GetById(id)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+	// spares generating a key, the repository checks again under the device lock
+	if device.State == domain.DeviceStateDecommissioned {
+		return nil, services.NewConflictError(services.CodeDeviceDecommissioned, "a decommissioned device can't get new keys")
+	}
+
+	keyHandle, err := s.keyStore.Generate(device.AlgorithmType, device.Options)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := s.repository.RotateDeviceKey(id, domain.DeviceSigner{
+		ID:            uuid.New().String(),
+		CreatedAt:     s.clock(),
+		AlgorithmType: device.AlgorithmType,
+		Options:       device.Options,
+		KeyHandle:     keyHandle,
+	})
+	if err != nil {
+		// the key would be orphaned otherwise
+		if destroyErr := s.keyStore.Destroy(keyHandle); destroyErr != nil {
+			logrus.WithError(destroyErr).Error("failed to destroy the key of a failed rotation")
+		}
+		return nil, err
+	}
+	if evicter, ok := s.keyStore.(keyEvicter); ok {
+		evicter.Evict(device.KeyHandle)
+	}
+	return signer, nil
+}
+
+// Save creates the device and its first key. A device without an id gets a random UUID, an id that is already taken
+// is answered with 409.
 func (s *SignatureDeviceServiceImpl) Save(input *domain.Device) error {
 	if input == nil {
-		return services.NewServiceError(fmt.Sprintf("invalid request"), http.StatusBadRequest)
+		return services.NewValidationError(services.CodeInvalidRequest, "invalid request")
 
 	}
 	if input.ID == "" {
-		return services.NewServiceError(fmt.Sprintf("id is a required field"), http.StatusBadRequest)
+		input.ID = uuid.New().String()
+	} else if err := validateID(input.ID, s.idPolicy); err != nil {
+		return err
+	}
+
+	options, err := resolveAlgorithmOptions(input.AlgorithmType, input.Options)
+	if err != nil {
+		return err
+	}
+	input.Options = options
+	if err = services.ValidateMetadata(input.Metadata); err != nil {
+		return err
 	}
 
-	publicKey, privateKey, err := s.createAlgorithmForType(input.AlgorithmType)
+	keyHandle, err := s.keyStore.Generate(input.AlgorithmType, input.Options)
 	if err != nil {
 		return err
 	}
-	input.PublicKey = publicKey
-	input.PrivateKey = privateKey
+	input.KeyID = uuid.New().String()
+	input.CreatedAt = s.clock()
+	input.KeyCreatedAt = input.CreatedAt
+	input.KeyHandle = keyHandle
+	input.State = domain.DeviceStateActive
+	input.Version = 1
+	// the counter is the number of signings, a new device has none whatever the client sent
+	input.Counter = 0
 
 	err = s.repository.Save(*input)
 	if err != nil {
+		// the key would be orphaned otherwise
+		if destroyErr := s.keyStore.Destroy(keyHandle); destroyErr != nil {
+			logrus.WithError(destroyErr).Error("failed to destroy the key of an unsaved device")
+		}
+		if errors.Is(err, domain.ErrDeviceExists) {
+			return services.NewConflictError(services.CodeDeviceExists, fmt.Sprintf("a device with id %s already exists", input.ID))
+		}
 		return err
 	}
 	return nil
 }
 
-func (s *SignatureDeviceServiceImpl) createAlgorithmForType(algorithmType domain.AlgorithmType) ([]byte, []byte, error) {
-	generatedAlgorithm, err := s.factory.GenerateAlgorithm(algorithmType)
+// UpdateState moves the device to state if the lifecycle allows it. Asking for the current state changes nothing.
+func (s *SignatureDeviceServiceImpl) UpdateState(id string, state domain.DeviceState) (*domain.Device, error) {
+	if _, valid := domain.ConvertStringToDeviceState(string(state)); !valid {
+		return nil, services.NewValidationError(services.CodeInvalidState, "state must be one of ACTIVE, SUSPENDED or DECOMMISSIONED")
+	}
+	device, err := s.GetById(id)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if device == nil {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+	if device.State == state {
+		return device, nil
+	}
+	if !canTransition(device.State, state) {
+		return nil, services.NewConflictError(services.CodeInvalidStateTransition, fmt.Sprintf("a %s device can't become %s", strings.ToLower(string(device.State)), strings.ToLower(string(state))))
 	}
 
-	marshaller, err := s.factory.CreateMarshaller(algorithmType)
+	if err = s.repository.UpdateDeviceState(id, device.State, state, s.clock); err != nil {
+		return nil, err
+	}
+	if evicter, ok := s.keyStore.(keyEvicter); ok && state != domain.DeviceStateActive {
+		evicter.Evict(device.KeyHandle)
+	}
+	return s.GetById(id)
+}
+
+// UpdateDetails applies the patch to the label and the metadata of the device. When version is set the device has to
+// still be at that version, so a client doesn't overwrite a change it hasn't seen. A patch that changes nothing
+// leaves the version as it is.
+func (s *SignatureDeviceServiceImpl) UpdateDetails(id string, version *int64, patch DevicePatch) (*domain.Device, error) {
+	device, err := s.GetById(id)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if device == nil {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+	if version != nil && *version != device.Version {
+		return nil, services.NewPreconditionFailedError(services.CodeDeviceModified, fmt.Sprintf("device was modified, its current version is %d", device.Version))
+	}
+
+	label := device.Label
+	if patch.SetLabel {
+		label = patch.Label
+	}
+	metadata := map[string]string{}
+	if !patch.ClearMetadata {
+		for key, value := range device.Metadata {
+			metadata[key] = value
+		}
+	}
+	for key, value := range patch.Metadata {
+		if value == nil {
+			delete(metadata, key)
+		} else {
+			metadata[key] = *value
+		}
+	}
+	if err = services.ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
+	if sameLabel(label, device.Label) && sameMetadata(metadata, device.Metadata) {
+		return device, nil
+	}
+
+	if err = s.repository.UpdateDeviceDetails(id, device.Version, label, metadata); err != nil {
+		return nil, err
+	}
+	return s.GetById(id)
+}
+
+func sameLabel(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, exists := b[key]; !exists || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// validateID checks a client supplied device id against the policy.
+func validateID(id string, policy IDPolicy) error {
+	if policy == IDPolicyUUID {
+		if _, err := uuid.Parse(id); err != nil || len(id) != len(uuid.Nil.String()) {
+			return services.NewValidationError(services.CodeInvalidID, "id must be a UUID")
+		}
+		return nil
+	}
+
+	if len(id) > maxDeviceIDLength {
+		return services.NewValidationError(services.CodeInvalidID, fmt.Sprintf("id can't be longer than %d characters", maxDeviceIDLength))
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return services.NewValidationError(services.CodeInvalidID, "id can only contain letters, digits, '-' and '_'")
+		}
+	}
+	return nil
+}
+
+func canTransition(from, to domain.DeviceState) bool {
+	for _, allowed := range allowedTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAlgorithmOptions validates the options requested for the algorithm and fills in the defaults,
+// so the stored device always reports the parameters it was created with.
+func resolveAlgorithmOptions(algorithmType domain.AlgorithmType, options domain.AlgorithmOptions) (domain.AlgorithmOptions, error) {
+	if algorithmType != domain.AlgorithmTypeECC && options.Curve != domain.CurveTypeUnknown {
+		return options, services.NewValidationError(services.CodeInvalidAlgorithm, "curve is only supported for the ECC algorithm")
+	}
+	if algorithmType != domain.AlgorithmTypeRSA && (options.KeySize != 0 || options.Padding != domain.PaddingTypeUnknown) {
+		return options, services.NewValidationError(services.CodeInvalidAlgorithm, "key_size and padding are only supported for the RSA algorithm")
+	}
+
+	switch algorithmType {
+	case domain.AlgorithmTypeECC:
+		return resolveECCOptions(options)
+	case domain.AlgorithmTypeRSA:
+		return resolveRSAOptions(options)
+	case domain.AlgorithmTypeEd25519:
+		return options, nil
+	default:
+		return options, services.NewValidationError(services.CodeInvalidAlgorithm, "algorithm must be one of RSA, ECC or ED25519")
+	}
+}
+
+func resolveECCOptions(options domain.AlgorithmOptions) (domain.AlgorithmOptions, error) {
+	switch options.Curve {
+	case domain.CurveTypeUnknown:
+		options.Curve = domain.CurveTypeP384
+	case domain.CurveTypeP256, domain.CurveTypeP384, domain.CurveTypeP521:
+	default:
+		return options, services.NewValidationError(services.CodeInvalidAlgorithm, "curve must be one of P-256, P-384 or P-521")
+	}
+	return options, nil
+}
+
+func resolveRSAOptions(options domain.AlgorithmOptions) (domain.AlgorithmOptions, error) {
+	switch options.KeySize {
+	case 0:
+		options.KeySize = minimumRSAKeySize
+	case 2048, 3072, 4096:
+	default:
+		return options, services.NewValidationError(services.CodeInvalidAlgorithm, fmt.Sprintf("key_size must be one of 2048, 3072 or 4096, at least %d bits are required", minimumRSAKeySize))
+	}
+
+	switch options.Padding {
+	case domain.PaddingTypeUnknown:
+		options.Padding = domain.PaddingTypePSS
+	case domain.PaddingTypePSS, domain.PaddingTypePKCS1v15:
+	default:
+		return options, services.NewValidationError(services.CodeInvalidAlgorithm, "padding must be one of PSS or PKCS1v15")
 	}
-	return marshaller.Encode(generatedAlgorithm)
+	return options, nil
 }
@@ -3,19 +3,26 @@ package device
 import (
 	"fmt"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"math"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/keystore"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/device/mocks"
 )
 
 func TestGetAll(t *testing.T) {
+	zero, one := int64(0), int64(1)
 	tests := []struct {
 		name                 string
+		filter               domain.DeviceFilter
 		inputPageNumber      int
 		inputPageSize        int
 		expectedTotalCount   int
@@ -53,6 +60,57 @@ func TestGetAll(t *testing.T) {
 			expectedServiceError: true,
 			mockData:             newMockData(0, 0, nil),
 		},
+		{
+			name:                 "Page offset overflowing",
+			inputPageNumber:      math.MaxInt/2 + 2,
+			inputPageSize:        2,
+			expectedServiceError: true,
+			mockData:             newMockData(0, 0, nil),
+		},
+		{
+			name:               "Filtered and sorted",
+			filter:             domain.DeviceFilter{Algorithm: domain.AlgorithmTypeRSA, MaxCounter: &zero, Label: "Store-42", Sort: domain.DeviceSortLabel, Descending: true},
+			inputPageNumber:    1,
+			inputPageSize:      10,
+			expectedTotalCount: 3,
+			expectedItemsCount: 3,
+			mockData:           newMockData(3, 3, nil),
+		},
+		{
+			name:                 "Unknown algorithm",
+			filter:               domain.DeviceFilter{Algorithm: "DSA"},
+			inputPageNumber:      1,
+			inputPageSize:        10,
+			expectedServiceError: true,
+		},
+		{
+			name:                 "Unknown state",
+			filter:               domain.DeviceFilter{State: "active"},
+			inputPageNumber:      1,
+			inputPageSize:        10,
+			expectedServiceError: true,
+		},
+		{
+			name:                 "Unknown sort",
+			filter:               domain.DeviceFilter{Sort: "key_id"},
+			inputPageNumber:      1,
+			inputPageSize:        10,
+			expectedServiceError: true,
+		},
+		{
+			name:                 "Empty creation range",
+			filter:               domain.DeviceFilter{CreatedFrom: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), CreatedTo: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+			inputPageNumber:      1,
+			inputPageSize:        10,
+			expectedServiceError: true,
+		},
+		{
+			name:                 "Inverted counter range",
+			filter:               domain.DeviceFilter{MinCounter: &one, MaxCounter: &zero},
+			inputPageNumber:      1,
+			inputPageSize:        10,
+			expectedServiceError: true,
+		},
 		{
 			name:               "Out of Range page",
 			inputPageNumber:    11,
@@ -68,17 +126,21 @@ func TestGetAll(t *testing.T) {
 			// setup
 			mockRepo := new(mocks.MockDeviceRepository)
 			if !test.expectedServiceError {
-				mockRepo.On("GetAll", test.inputPageNumber, test.inputPageSize).
+				mockRepo.On("GetAll", test.filter, test.inputPageNumber, test.inputPageSize).
 					Return(test.mockData.Devices, test.mockData.TotalCount, test.mockData.Error)
 			}
 
-			service := NewDeviceService(mockRepo, nil)
+			service := NewDeviceService(mockRepo, nil, IDPolicySafe, services.SystemClock)
 
 			// execute
-			devices, totalCount, err := service.GetAll(test.inputPageNumber, test.inputPageSize)
+			devices, totalCount, err := service.GetAll(test.filter, test.inputPageNumber, test.inputPageSize)
 
 			if test.expectedServiceError || test.expectedDbError {
 				assert.Error(t, err)
+				var serviceError *services.ServiceError
+				if test.filter != (domain.DeviceFilter{}) && assert.ErrorAs(t, err, &serviceError) {
+					assert.Equal(t, services.CodeInvalidFilter, serviceError.Code)
+				}
 			} else {
 				assert.NoError(t, err)
 				assert.Equal(t, test.expectedTotalCount, totalCount)
@@ -90,6 +152,121 @@ func TestGetAll(t *testing.T) {
 	}
 }
 
+func TestGetPage(t *testing.T) {
+	at := func(id string) *domain.PageCursor { return &domain.PageCursor{ID: id} }
+	before := func(id string) *domain.PageCursor { return &domain.PageCursor{ID: id, Backward: true} }
+	tests := []struct {
+		name                 string
+		filter               domain.DeviceFilter
+		cursor               *domain.PageCursor
+		inputPageSize        int
+		mockData             mockData
+		more                 bool
+		expectedNext         *domain.PageCursor
+		expectedPrev         *domain.PageCursor
+		expectedServiceError bool
+	}{
+		{
+			name:          "First page",
+			inputPageSize: 2,
+			mockData:      newMockData(2, 0, nil),
+			more:          true,
+			expectedNext:  at("1"),
+		},
+		{
+			name:          "Only page",
+			inputPageSize: 2,
+			mockData:      newMockData(1, 0, nil),
+		},
+		{
+			name:          "Middle page",
+			cursor:        at("x"),
+			inputPageSize: 2,
+			mockData:      newMockData(2, 0, nil),
+			more:          true,
+			expectedNext:  at("1"),
+			expectedPrev:  before("0"),
+		},
+		{
+			name:          "Last page",
+			cursor:        at("x"),
+			inputPageSize: 2,
+			mockData:      newMockData(2, 0, nil),
+			expectedPrev:  before("0"),
+		},
+		{
+			name:          "Backward to the first page",
+			cursor:        before("x"),
+			inputPageSize: 2,
+			mockData:      newMockData(2, 0, nil),
+			expectedNext:  at("1"),
+		},
+		{
+			name:          "Past the end",
+			cursor:        at("x"),
+			inputPageSize: 2,
+			mockData:      newMockData(0, 0, nil),
+			expectedPrev:  before("x"),
+		},
+		{
+			name:          "Repository Error",
+			inputPageSize: 2,
+			mockData:      newMockData(0, 0, fmt.Errorf("repository error")),
+		},
+		{
+			name:          "Filtered",
+			filter:        domain.DeviceFilter{State: domain.DeviceStateSuspended},
+			inputPageSize: 2,
+			mockData:      newMockData(1, 0, nil),
+		},
+		{
+			name:                 "Invalid Page Size",
+			inputPageSize:        0,
+			expectedServiceError: true,
+		},
+		{
+			name:                 "Sorted by another field",
+			filter:               domain.DeviceFilter{Sort: domain.DeviceSortCounter},
+			inputPageSize:        2,
+			expectedServiceError: true,
+		},
+		{
+			name:                 "Sorted descending",
+			filter:               domain.DeviceFilter{Descending: true},
+			inputPageSize:        2,
+			expectedServiceError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			mockRepo := new(mocks.MockDeviceRepository)
+			if !test.expectedServiceError {
+				mockRepo.On("GetDevicesPage", test.filter, test.cursor, test.inputPageSize).
+					Return(test.mockData.Devices, test.more, test.mockData.Error)
+			}
+
+			service := NewDeviceService(mockRepo, nil, IDPolicySafe, services.SystemClock)
+
+			// execute
+			page, err := service.GetPage(test.filter, test.cursor, test.inputPageSize)
+
+			// asserts
+			if test.expectedServiceError || test.mockData.Error != nil {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.mockData.Devices, page.Items)
+				assert.Equal(t, test.expectedNext, page.Next)
+				assert.Equal(t, test.expectedPrev, page.Prev)
+			}
+
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
 func TestGetById(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -118,7 +295,7 @@ func TestGetById(t *testing.T) {
 			mockRepo.On("FindByID", test.inputDeviceId).
 				Return(test.mockDevice, test.mockError)
 
-			service := NewDeviceService(mockRepo, nil)
+			service := NewDeviceService(mockRepo, nil, IDPolicySafe, services.SystemClock)
 
 			// execute
 			device, err := service.GetById(test.inputDeviceId)
@@ -139,12 +316,16 @@ func TestGetById(t *testing.T) {
 }
 
 func TestSave(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
 	tests := []struct {
 		name                 string
 		inputDevice          *domain.Device
+		idPolicy             IDPolicy
 		mockError            error
 		expectedServiceError bool
 		expectedDbError      bool
+		expectedCode         string
+		expectedOptions      domain.AlgorithmOptions
 	}{
 		{
 			name: "Valid ECC Type",
@@ -152,6 +333,51 @@ func TestSave(t *testing.T) {
 				ID:            "1",
 				AlgorithmType: domain.AlgorithmTypeECC,
 			},
+			expectedOptions: domain.AlgorithmOptions{Curve: domain.CurveTypeP384},
+		},
+		{
+			name: "Counter sent by the client",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+				Counter:       5,
+			},
+		},
+		{
+			name: "Valid ECC Type with P-256",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeECC,
+				Options:       domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+			},
+			expectedOptions: domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+		},
+		{
+			name: "Valid ECC Type with P-521",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeECC,
+				Options:       domain.AlgorithmOptions{Curve: domain.CurveTypeP521},
+			},
+			expectedOptions: domain.AlgorithmOptions{Curve: domain.CurveTypeP521},
+		},
+		{
+			name: "Invalid ECC curve",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeECC,
+				Options:       domain.AlgorithmOptions{Curve: "P-224"},
+			},
+			expectedServiceError: true,
+		},
+		{
+			name: "Curve with RSA Type",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeRSA,
+				Options:       domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+			},
+			expectedServiceError: true,
 		},
 		{
 			name: "Valid RSA Type",
@@ -159,6 +385,50 @@ func TestSave(t *testing.T) {
 				ID:            "1",
 				AlgorithmType: domain.AlgorithmTypeRSA,
 			},
+			expectedOptions: domain.AlgorithmOptions{KeySize: 2048, Padding: domain.PaddingTypePSS},
+		},
+		{
+			name: "Valid RSA Type with 3072 bits and PKCS1v15",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeRSA,
+				Options:       domain.AlgorithmOptions{KeySize: 3072, Padding: domain.PaddingTypePKCS1v15},
+			},
+			expectedOptions: domain.AlgorithmOptions{KeySize: 3072, Padding: domain.PaddingTypePKCS1v15},
+		},
+		{
+			name: "RSA key size below minimum",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeRSA,
+				Options:       domain.AlgorithmOptions{KeySize: 1024},
+			},
+			expectedServiceError: true,
+		},
+		{
+			name: "Invalid RSA padding",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeRSA,
+				Options:       domain.AlgorithmOptions{Padding: "OAEP"},
+			},
+			expectedServiceError: true,
+		},
+		{
+			name: "Key size with ECC Type",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeECC,
+				Options:       domain.AlgorithmOptions{KeySize: 2048},
+			},
+			expectedServiceError: true,
+		},
+		{
+			name: "Valid Ed25519 Type",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+			},
 		},
 		{
 			name: "Invalid Algorithm Type",
@@ -169,12 +439,58 @@ func TestSave(t *testing.T) {
 			expectedServiceError: true,
 		},
 		{
-			name: "Invalid Id",
+			name: "Generated Id",
 			inputDevice: &domain.Device{
 				ID:            "",
-				AlgorithmType: domain.AlgorithmTypeRSA,
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+			},
+			idPolicy: IDPolicyUUID,
+		},
+		{
+			name: "Id with a slash",
+			inputDevice: &domain.Device{
+				ID:            "till/1",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
 			},
 			expectedServiceError: true,
+			expectedCode:         services.CodeInvalidID,
+		},
+		{
+			name: "Id too long",
+			inputDevice: &domain.Device{
+				ID:            strings.Repeat("a", maxDeviceIDLength+1),
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+			},
+			expectedServiceError: true,
+			expectedCode:         services.CodeInvalidID,
+		},
+		{
+			name: "UUID Id",
+			inputDevice: &domain.Device{
+				ID:            "6f1c1a44-9f47-4a2e-8a4e-0f5a2b1f3c9d",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+			},
+			idPolicy: IDPolicyUUID,
+		},
+		{
+			name: "Id not a UUID",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+			},
+			idPolicy:             IDPolicyUUID,
+			expectedServiceError: true,
+			expectedCode:         services.CodeInvalidID,
+		},
+		{
+			name: "Duplicated Id",
+			inputDevice: &domain.Device{
+				ID:            "1",
+				AlgorithmType: domain.AlgorithmTypeEd25519,
+			},
+			mockError:       domain.ErrDeviceExists,
+			expectedDbError: true,
+			expectedCode:    services.CodeDeviceExists,
 		},
 		{
 			name:                 "Invalid Input",
@@ -196,8 +512,8 @@ func TestSave(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			mockRepo := new(mocks.MockDeviceRepository)
 			// usually we need to mock things here but for simplicity we can use the real one
-			factory := crypto.NewFactory()
-			service := NewDeviceService(mockRepo, factory)
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			service := NewDeviceService(mockRepo, keyStore, test.idPolicy, func() time.Time { return createdAt })
 			if !test.expectedServiceError {
 				mockRepo.On("Save", mock.Anything).Return(test.mockError)
 			}
@@ -206,8 +522,24 @@ func TestSave(t *testing.T) {
 
 			if test.expectedDbError || test.expectedServiceError {
 				assert.Error(t, err)
+				if test.expectedCode != "" {
+					var serviceError *services.ServiceError
+					assert.ErrorAs(t, err, &serviceError)
+					assert.Equal(t, test.expectedCode, serviceError.Code)
+				}
+				if test.inputDevice != nil && test.inputDevice.KeyHandle != "" {
+					// no key may be left behind for a device that was not stored
+					_, err = keyStore.PublicKey(test.inputDevice.KeyHandle)
+					assert.ErrorIs(t, err, keystore.ErrKeyNotFound)
+				}
 			} else {
 				assert.NoError(t, err)
+				assert.Equal(t, test.expectedOptions, test.inputDevice.Options)
+				assert.NotEmpty(t, test.inputDevice.KeyID)
+				assert.Equal(t, createdAt, test.inputDevice.CreatedAt)
+				assert.Equal(t, createdAt, test.inputDevice.KeyCreatedAt)
+				assert.Zero(t, test.inputDevice.Counter, "new devices have no signings")
+				assert.NoError(t, validateID(test.inputDevice.ID, test.idPolicy), "generated ids satisfy every policy")
 			}
 			if !test.expectedServiceError {
 				mockRepo.AssertExpectations(t)
@@ -218,6 +550,377 @@ func TestSave(t *testing.T) {
 
 }
 
+func TestGetPublicKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		tp            domain.AlgorithmType
+		keyID         string
+		mockError     error
+		expectedError bool
+	}{
+		{
+			name: "ECC public key",
+			tp:   domain.AlgorithmTypeECC,
+		},
+		{
+			name:  "Public key of a rotated key",
+			tp:    domain.AlgorithmTypeECC,
+			keyID: "key-1",
+		},
+		{
+			name:          "Unknown key id",
+			tp:            domain.AlgorithmTypeECC,
+			keyID:         "key-3",
+			expectedError: true,
+		},
+		{
+			name: "RSA public key",
+			tp:   domain.AlgorithmTypeRSA,
+		},
+		{
+			name: "Ed25519 public key",
+			tp:   domain.AlgorithmTypeEd25519,
+		},
+		{
+			name:          "Db Error",
+			tp:            domain.AlgorithmTypeECC,
+			mockError:     fmt.Errorf("db error"),
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			keyHandle, err := keyStore.Generate(test.tp, domain.AlgorithmOptions{})
+			assert.NoError(t, err)
+
+			mockRepo := new(mocks.MockDeviceRepository)
+			if test.mockError != nil {
+				mockRepo.On("FindByID", "1").Return(nil, test.mockError)
+			} else if test.keyID == "" {
+				mockRepo.On("FindByID", "1").Return(&domain.Device{
+					ID:            "1",
+					AlgorithmType: test.tp,
+					KeyID:         "key-1",
+					KeyHandle:     keyHandle,
+				}, nil)
+			} else {
+				// the device signs with a newer key, the requested one was rotated out
+				activeHandle, err := keyStore.Generate(test.tp, domain.AlgorithmOptions{})
+				assert.NoError(t, err)
+				mockRepo.On("FindByID", "1").Return(&domain.Device{
+					ID:            "1",
+					AlgorithmType: test.tp,
+					KeyID:         "key-2",
+					KeyHandle:     activeHandle,
+				}, nil)
+				mockRepo.On("GetDeviceSigners", "1").Return([]*domain.DeviceSigner{
+					{ID: "key-1", Version: 1, KeyHandle: keyHandle},
+					{ID: "key-2", Version: 2, KeyHandle: activeHandle},
+				}, nil)
+			}
+			service := NewDeviceService(mockRepo, keyStore, IDPolicySafe, services.SystemClock)
+
+			// execute
+			verifier, keyID, err := service.GetPublicKey("1", test.keyID)
+
+			// assertions
+			if test.expectedError {
+				assert.Error(t, err)
+				assert.Nil(t, verifier)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "key-1", keyID, "the id of the returned key")
+				signature, err := keyStore.Sign(keyHandle, []byte("data"))
+				assert.NoError(t, err)
+				assert.NoError(t, verifier.VerifySignature([]byte("data"), signature))
+			}
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	changedAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		currentState  domain.DeviceState
+		inputState    domain.DeviceState
+		mockError     error
+		expectUpdate  bool
+		expectedError bool
+	}{
+		{
+			name:         "Suspend an active device",
+			currentState: domain.DeviceStateActive,
+			inputState:   domain.DeviceStateSuspended,
+			expectUpdate: true,
+		},
+		{
+			name:         "Reactivate a suspended device",
+			currentState: domain.DeviceStateSuspended,
+			inputState:   domain.DeviceStateActive,
+			expectUpdate: true,
+		},
+		{
+			name:         "Decommission a suspended device",
+			currentState: domain.DeviceStateSuspended,
+			inputState:   domain.DeviceStateDecommissioned,
+			expectUpdate: true,
+		},
+		{
+			name:         "Same state is a no-op",
+			currentState: domain.DeviceStateActive,
+			inputState:   domain.DeviceStateActive,
+		},
+		{
+			name:          "Decommissioned devices stay retired",
+			currentState:  domain.DeviceStateDecommissioned,
+			inputState:    domain.DeviceStateActive,
+			expectedError: true,
+		},
+		{
+			name:          "Unknown state",
+			currentState:  domain.DeviceStateActive,
+			inputState:    "BROKEN",
+			expectedError: true,
+		},
+		{
+			name:          "Concurrent change",
+			currentState:  domain.DeviceStateActive,
+			inputState:    domain.DeviceStateSuspended,
+			mockError:     fmt.Errorf("device state was changed concurrently"),
+			expectUpdate:  true,
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			mockRepo := new(mocks.MockDeviceRepository)
+			service := NewDeviceService(mockRepo, keystore.NewSoftwareKeyStore(crypto.NewFactory()), IDPolicySafe, func() time.Time { return changedAt })
+			if _, valid := domain.ConvertStringToDeviceState(string(test.inputState)); valid {
+				mockRepo.On("FindByID", "1").Return(&domain.Device{ID: "1", State: test.currentState}, nil).Once()
+			}
+			if test.expectUpdate {
+				mockRepo.On("UpdateDeviceState", "1", test.currentState, test.inputState, changedAt).Return(test.mockError).Once()
+				if test.mockError == nil {
+					mockRepo.On("FindByID", "1").Return(&domain.Device{ID: "1", State: test.inputState}, nil).Once()
+				}
+			}
+
+			// execute
+			device, err := service.UpdateState("1", test.inputState)
+
+			// assertions
+			if test.expectedError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.inputState, device.State)
+			}
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUpdateDetails(t *testing.T) {
+	label := func(value string) *string {
+		return &value
+	}
+	tooMany := map[string]*string{}
+	for i := 0; i <= services.MaxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("key-%d", i)] = label("value")
+	}
+
+	tests := []struct {
+		name             string
+		version          *int64
+		patch            DevicePatch
+		mockError        error
+		expectUpdate     bool
+		expectedLabel    *string
+		expectedMetadata map[string]string
+		expectedCode     string
+	}{
+		{
+			name:             "Rename the device",
+			patch:            DevicePatch{SetLabel: true, Label: label("till 2")},
+			expectUpdate:     true,
+			expectedLabel:    label("till 2"),
+			expectedMetadata: map[string]string{"store": "berlin-1", "floor": "1"},
+		},
+		{
+			name:             "Remove the label",
+			patch:            DevicePatch{SetLabel: true},
+			expectUpdate:     true,
+			expectedMetadata: map[string]string{"store": "berlin-1", "floor": "1"},
+		},
+		{
+			name:             "Merge the metadata",
+			patch:            DevicePatch{Metadata: map[string]*string{"floor": nil, "till": label("3")}},
+			expectUpdate:     true,
+			expectedLabel:    label("till 1"),
+			expectedMetadata: map[string]string{"store": "berlin-1", "till": "3"},
+		},
+		{
+			name:             "Replace the metadata",
+			patch:            DevicePatch{ClearMetadata: true, Metadata: map[string]*string{"till": label("3")}},
+			expectUpdate:     true,
+			expectedLabel:    label("till 1"),
+			expectedMetadata: map[string]string{"till": "3"},
+		},
+		{
+			name:             "Matching version",
+			version:          func() *int64 { version := int64(4); return &version }(),
+			patch:            DevicePatch{SetLabel: true, Label: label("till 2")},
+			expectUpdate:     true,
+			expectedLabel:    label("till 2"),
+			expectedMetadata: map[string]string{"store": "berlin-1", "floor": "1"},
+		},
+		{
+			name:  "Unchanged patch",
+			patch: DevicePatch{SetLabel: true, Label: label("till 1"), Metadata: map[string]*string{"floor": label("1")}},
+		},
+		{
+			name:         "Stale version",
+			version:      func() *int64 { version := int64(3); return &version }(),
+			patch:        DevicePatch{SetLabel: true, Label: label("till 2")},
+			expectedCode: services.CodeDeviceModified,
+		},
+		{
+			name:             "Concurrent change",
+			patch:            DevicePatch{SetLabel: true, Label: label("till 2")},
+			mockError:        services.NewPreconditionFailedError(services.CodeDeviceModified, "device was modified concurrently, fetch it and retry"),
+			expectUpdate:     true,
+			expectedLabel:    label("till 2"),
+			expectedMetadata: map[string]string{"store": "berlin-1", "floor": "1"},
+			expectedCode:     services.CodeDeviceModified,
+		},
+		{
+			name:         "Too many metadata entries",
+			patch:        DevicePatch{Metadata: tooMany},
+			expectedCode: services.CodeInvalidMetadata,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			mockRepo := new(mocks.MockDeviceRepository)
+			service := NewDeviceService(mockRepo, keystore.NewSoftwareKeyStore(crypto.NewFactory()), IDPolicySafe, services.SystemClock)
+			device := &domain.Device{ID: "1", Label: label("till 1"), Metadata: map[string]string{"store": "berlin-1", "floor": "1"}, Version: 4}
+			mockRepo.On("FindByID", "1").Return(device, nil).Once()
+			if test.expectUpdate {
+				mockRepo.On("UpdateDeviceDetails", "1", int64(4), test.expectedLabel, test.expectedMetadata).Return(test.mockError).Once()
+				if test.mockError == nil {
+					mockRepo.On("FindByID", "1").Return(&domain.Device{ID: "1", Label: test.expectedLabel, Metadata: test.expectedMetadata, Version: 5}, nil).Once()
+				}
+			}
+
+			// execute
+			updated, err := service.UpdateDetails("1", test.version, test.patch)
+
+			// assertions
+			if test.expectedCode != "" {
+				var serviceError *services.ServiceError
+				assert.ErrorAs(t, err, &serviceError)
+				assert.Equal(t, test.expectedCode, serviceError.Code)
+			} else {
+				assert.NoError(t, err)
+				if test.expectUpdate {
+					assert.Equal(t, int64(5), updated.Version)
+				} else {
+					assert.Equal(t, device, updated)
+				}
+			}
+			assert.Equal(t, map[string]string{"store": "berlin-1", "floor": "1"}, device.Metadata, "the stored metadata is never changed in place")
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		state         domain.DeviceState
+		mockError     error
+		expectRotate  bool
+		expectedError bool
+	}{
+		{
+			name:         "Rotate the key of an active device",
+			state:        domain.DeviceStateActive,
+			expectRotate: true,
+		},
+		{
+			name:         "Rotate the key of a suspended device",
+			state:        domain.DeviceStateSuspended,
+			expectRotate: true,
+		},
+		{
+			name:          "Decommissioned devices get no new keys",
+			state:         domain.DeviceStateDecommissioned,
+			expectedError: true,
+		},
+		{
+			name:          "Db Error",
+			state:         domain.DeviceStateActive,
+			mockError:     fmt.Errorf("db error"),
+			expectRotate:  true,
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			oldHandle, err := keyStore.Generate(domain.AlgorithmTypeECC, domain.AlgorithmOptions{Curve: domain.CurveTypeP256})
+			assert.NoError(t, err)
+			device := &domain.Device{ID: "1", AlgorithmType: domain.AlgorithmTypeECC, Options: domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+				State: test.state, KeyID: "key-1", KeyHandle: oldHandle}
+
+			mockRepo := new(mocks.MockDeviceRepository)
+			mockRepo.On("FindByID", "1").Return(device, nil).Once()
+			var newHandle string
+			if test.expectRotate {
+				rotate := mockRepo.On("RotateDeviceKey", "1", mock.MatchedBy(func(signer domain.DeviceSigner) bool {
+					newHandle = signer.KeyHandle
+					return signer.ID != "" && signer.AlgorithmType == device.AlgorithmType && signer.Options == device.Options &&
+						signer.KeyHandle != oldHandle && signer.CreatedAt.Equal(createdAt)
+				})).Once()
+				if test.mockError != nil {
+					rotate.Return(nil, test.mockError)
+				} else {
+					rotate.Return(&domain.DeviceSigner{ID: "key-2", Version: 2}, nil)
+				}
+			}
+			service := NewDeviceService(mockRepo, keyStore, IDPolicySafe, func() time.Time { return createdAt })
+
+			// execute
+			signer, err := service.RotateKey("1")
+
+			// assertions
+			if test.expectedError {
+				assert.Error(t, err)
+				if newHandle != "" {
+					// the key of a rotation that was not stored is destroyed
+					_, err = keyStore.PublicKey(newHandle)
+					assert.ErrorIs(t, err, keystore.ErrKeyNotFound)
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, 2, signer.Version)
+				// the old key is kept for verification
+				_, err = keyStore.PublicKey(oldHandle)
+				assert.NoError(t, err)
+			}
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
 type mockData struct {
 	Devices    []*domain.Device
 	TotalCount int
@@ -1,30 +1,69 @@
 package services
 
-import (
-	"fmt"
+// ErrorKind classifies a ServiceError, the API derives the response status from it.
+type ErrorKind string
+
+const (
+	ErrorKindValidation         ErrorKind = "validation"
+	ErrorKindNotFound           ErrorKind = "not_found"
+	ErrorKindConflict           ErrorKind = "conflict"
+	ErrorKindPreconditionFailed ErrorKind = "precondition_failed"
+	ErrorKindInternal           ErrorKind = "internal"
+)
+
+// Error codes are part of the API: clients branch on them, so they never change once released.
+const (
+	CodeInvalidRequest         = "invalid_request"
+	CodeInvalidID              = "invalid_id"
+	CodeInvalidAlgorithm       = "invalid_algorithm"
+	CodeInvalidMetadata        = "invalid_metadata"
+	CodeImmutableField         = "immutable_field"
+	CodeInvalidState           = "invalid_state"
+	CodeInvalidPage            = "invalid_page"
+	CodeInvalidFilter          = "invalid_filter"
+	CodeDeviceNotFound         = "device_not_found"
+	CodeKeyNotFound            = "key_not_found"
+	CodeSigningNotFound        = "signing_not_found"
+	CodeDeviceExists           = "device_exists"
+	CodeDeviceNotActive        = "device_not_active"
+	CodeDeviceDecommissioned   = "device_decommissioned"
+	CodeInvalidStateTransition = "invalid_state_transition"
+	CodeDeviceModified         = "device_modified"
+	CodeInternal               = "internal_error"
 )
 
+// ServiceError is an error that can be shown to the client: its message is meant to be read by the caller and
+// Code identifies it. Any other error is internal and its details are only logged.
 type ServiceError struct {
-	msg    string
-	Status int
+	msg  string
+	Kind ErrorKind
+	Code string
 }
 
 func (r *ServiceError) Error() string {
-	return fmt.Sprintf("validation error: %v", r.msg)
+	return r.msg
+}
+
+func NewServiceError(kind ErrorKind, code string, msg string) *ServiceError {
+	return &ServiceError{msg: msg, Kind: kind, Code: code}
+}
+
+func NewValidationError(code string, msg string) *ServiceError {
+	return NewServiceError(ErrorKindValidation, code, msg)
 }
 
-func NewServiceError(msg string, status int) *ServiceError {
-	return &ServiceError{msg: msg, Status: status}
+func NewNotFoundError(code string, msg string) *ServiceError {
+	return NewServiceError(ErrorKindNotFound, code, msg)
 }
 
-type DBError struct {
-	msg string
+func NewConflictError(code string, msg string) *ServiceError {
+	return NewServiceError(ErrorKindConflict, code, msg)
 }
 
-func (r *DBError) Error() string {
-	return fmt.Sprintf("error: %v", r.msg)
+func NewPreconditionFailedError(code string, msg string) *ServiceError {
+	return NewServiceError(ErrorKindPreconditionFailed, code, msg)
 }
 
-func NewDBError(msg string) *DBError {
-	return &DBError{msg: msg}
+func NewInternalError(code string, msg string) *ServiceError {
+	return NewServiceError(ErrorKindInternal, code, msg)
 }
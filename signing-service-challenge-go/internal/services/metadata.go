@@ -0,0 +1,29 @@
+package services
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// limits of the metadata of devices and signings, it describes them and is not meant to store data
+const (
+	MaxMetadataEntries     = 32
+	MaxMetadataKeyLength   = 64
+	MaxMetadataValueLength = 256
+)
+
+// ValidateMetadata checks the metadata a client attaches to a device or a signing against the limits.
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return NewValidationError(CodeInvalidMetadata, fmt.Sprintf("metadata can have at most %d entries", MaxMetadataEntries))
+	}
+	for key, value := range metadata {
+		if key == "" || utf8.RuneCountInString(key) > MaxMetadataKeyLength {
+			return NewValidationError(CodeInvalidMetadata, fmt.Sprintf("metadata keys must have 1 to %d characters", MaxMetadataKeyLength))
+		}
+		if utf8.RuneCountInString(value) > MaxMetadataValueLength {
+			return NewValidationError(CodeInvalidMetadata, fmt.Sprintf("metadata values can have at most %d characters", MaxMetadataValueLength))
+		}
+	}
+	return nil
+}
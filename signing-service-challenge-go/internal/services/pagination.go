@@ -0,0 +1,54 @@
+package services
+
+import (
+	"math"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+)
+
+// ValidatePageOffset rejects a page whose offset, the (pageNr-1)*pageSize items before it, doesn't fit an int. Such
+// a page is past the end of any listing, but the storages couldn't compute where it starts.
+func ValidatePageOffset(pageNr int, pageSize int) error {
+	if pageSize > 0 && pageNr-1 > math.MaxInt/pageSize {
+		return NewValidationError(CodeInvalidPage, "pageNr is too large for the pageSize")
+	}
+	return nil
+}
+
+// NewCursorPage builds the page of items a repository returned for cursor, with more telling whether items are left
+// past the page in its direction. position is the cursor of an item, the links point next to the first and the last
+// item. A page past either end links back to where it was requested from.
+func NewCursorPage[T any](items []*T, cursor *domain.PageCursor, more bool, position func(*T) domain.PageCursor) *domain.CursorPage[T] {
+	page := &domain.CursorPage[T]{Items: items}
+	backward := cursor != nil && cursor.Backward
+	if len(items) == 0 {
+		if cursor != nil {
+			back := *cursor
+			back.Backward = !backward
+			if backward {
+				page.Next = &back
+			} else {
+				page.Prev = &back
+			}
+		}
+		return page
+	}
+
+	first := position(items[0])
+	first.Backward = true
+	last := position(items[len(items)-1])
+	if backward {
+		page.Next = &last
+		if more {
+			page.Prev = &first
+		}
+	} else {
+		if more {
+			page.Next = &last
+		}
+		if cursor != nil {
+			page.Prev = &first
+		}
+	}
+	return page
+}
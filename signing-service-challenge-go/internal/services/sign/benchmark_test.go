@@ -0,0 +1,54 @@
+package sign
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/keystore"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/persistence"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+// BenchmarkSignParallel signs from all the available goroutines spread over a growing number of devices.
+// With a single device every signing waits for the one before it, with more devices the throughput should grow
+// until it is bound by the CPUs, as unrelated devices never share a lock:
+//
+//	go test ./internal/services/sign -run '^$' -bench SignParallel -cpu 1,4,8
+func BenchmarkSignParallel(b *testing.B) {
+	for _, devices := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("devices=%d", devices), func(b *testing.B) {
+			storage := persistence.NewInMemoryStorage()
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			service := NewSignService(storage, keyStore, services.SystemClock)
+
+			ids := make([]string, devices)
+			for i := range ids {
+				keyHandle, err := keyStore.Generate(domain.AlgorithmTypeECC, domain.AlgorithmOptions{Curve: domain.CurveTypeP256})
+				if err != nil {
+					b.Fatal(err)
+				}
+				ids[i] = "device-" + strconv.Itoa(i)
+				if err = storage.Save(domain.Device{ID: ids[i], AlgorithmType: domain.AlgorithmTypeECC, KeyHandle: keyHandle}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			var next atomic.Int64
+			data := []byte("receipt")
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := ids[int(next.Add(1))%devices]
+					if _, err := service.Sign(id, data, nil); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package mocks
+
+import (
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockKeyStore struct {
+	mock.Mock
+}
+
+func (m *MockKeyStore) Sign(handle string, data []byte) ([]byte, error) {
+	args := m.Called(handle, data)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (m *MockKeyStore) PublicKey(handle string) (crypto.Verifier, error) {
+	args := m.Called(handle)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(crypto.Verifier), args.Error(1)
+}
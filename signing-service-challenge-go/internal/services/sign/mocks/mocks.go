@@ -23,12 +23,68 @@ func (m *MockSignRepository) GetAllSignings(deviceId string, pageNr int, pageSiz
 	return args.Get(0).([]*domain.Signings), args.Int(1), args.Error(2)
 }
 
-func (m *MockSignRepository) GetDeviceCounterAndLastEncoded(id string) (int64, string, error) {
+func (m *MockSignRepository) GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) ([]*domain.Signings, bool, error) {
+	args := m.Called(deviceId, cursor, pageSize)
+	return args.Get(0).([]*domain.Signings), args.Bool(1), args.Error(2)
+}
+
+func (m *MockSignRepository) GetSigningByCounter(deviceId string, counter int64) (*domain.Signings, error) {
+	args := m.Called(deviceId, counter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.Signings), args.Error(1)
+}
+
+func (m *MockSignRepository) GetSigningByID(id string) (*domain.Signings, error) {
 	args := m.Called(id)
-	return args.Get(0).(int64), args.String(1), args.Error(2)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*domain.Signings), args.Error(1)
+}
+
+// AppendSigning returns the stored counter, the last signature, the active key handle, a read error and a store error
+// set up by the test and runs sign in between like a real repository would.
+func (m *MockSignRepository) AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error) {
+	args := m.Called(deviceId)
+	if err := args.Error(3); err != nil {
+		return nil, err
+	}
+
+	counter := args.Get(0).(int64) + 1
+	signature, signedData, err := sign(counter, args.String(1), args.String(2))
+	if err != nil {
+		return nil, err
+	}
+	if err = args.Error(4); err != nil {
+		return nil, err
+	}
+	signing := &domain.Signings{
+		DeviceId:   deviceId,
+		Counter:    counter,
+		Signature:  signature,
+		SignedData: signedData,
+		Metadata:   details.Metadata,
+	}
+	if details.Clock != nil {
+		signing.CreatedAt = details.Clock()
+	}
+	return signing, nil
 }
 
-func (m *MockSignRepository) SaveDeviceCounterAndLastEncoded(id string, counter int64, currentSignature, data string) error {
-	args := m.Called(id, counter, currentSignature, data)
-	return args.Error(0)
+func (m *MockSignRepository) GetSigningChain(deviceId string) ([]*domain.Signings, error) {
+	args := m.Called(deviceId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*domain.Signings), args.Error(1)
+}
+
+func (m *MockSignRepository) GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error) {
+	args := m.Called(deviceId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*domain.DeviceSigner), args.Error(1)
 }
@@ -2,9 +2,8 @@ package sign
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"net/http"
-	"sync"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
@@ -12,115 +11,153 @@ import (
 )
 
 type SignService interface {
-	Sign(deviceID string, data []byte) (string, string, error)
+	Sign(deviceID string, data []byte, metadata map[string]string) (*domain.Signings, error)
 	GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error)
+	GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) (*domain.CursorPage[domain.Signings], error)
+	GetSigning(deviceId string, counter int64) (*domain.Signings, error)
+	GetSigningByID(id string) (*domain.Signings, error)
 }
 
 type SignRepository interface {
 	FindByID(id string) (*domain.Device, error)
 	GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error)
-	GetDeviceCounterAndLastEncoded(id string) (int64, string, error)
-	SaveDeviceCounterAndLastEncoded(id string, counter int64, currentSignature, data string) error
+	GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) ([]*domain.Signings, bool, error)
+	GetSigningByCounter(deviceId string, counter int64) (*domain.Signings, error)
+	GetSigningByID(id string) (*domain.Signings, error)
+	// AppendSigning reserves the next counter of the device, calls sign with it and the active key and stores the result
+	// as one atomic step together with the details
+	AppendSigning(deviceId string, details domain.SigningDetails, sign domain.SignFunc) (*domain.Signings, error)
 }
 
-type CryptoFactory interface {
-	CreateMarshaller(input domain.AlgorithmType) (crypto.AlgorithmMarshaller, error)
+type KeyStore interface {
+	Sign(handle string, data []byte) ([]byte, error)
+	PublicKey(handle string) (crypto.Verifier, error)
 }
 
 type SignServiceImpl struct {
-	repository    SignRepository
-	cryptoFactory CryptoFactory
-	counterMu     sync.Mutex
+	repository SignRepository
+	keyStore   KeyStore
+	clock      services.Clock
 }
 
-func NewSignService(repository SignRepository, factory CryptoFactory) *SignServiceImpl {
+func NewSignService(repository SignRepository, keyStore KeyStore, clock services.Clock) *SignServiceImpl {
 	return &SignServiceImpl{
-		repository:    repository,
-		cryptoFactory: factory,
-		counterMu:     sync.Mutex{},
+		repository: repository,
+		keyStore:   keyStore,
+		clock:      clock,
 	}
 }
 func (sc *SignServiceImpl) GetAllSignings(deviceId string, pageNr int, pageSize int) ([]*domain.Signings, int, error) {
 	if deviceId == "" {
-		return nil, 0, services.NewServiceError("deviceId is required", http.StatusBadRequest)
+		return nil, 0, services.NewValidationError(services.CodeInvalidRequest, "deviceId is required")
 	}
 	if pageNr <= 0 {
-		return nil, 0, services.NewServiceError("pageNr is required", http.StatusBadRequest)
+		return nil, 0, services.NewValidationError(services.CodeInvalidPage, "pageNr is required")
 	}
 	if pageSize <= 0 {
-		return nil, 0, services.NewServiceError("pageSize is required", http.StatusBadRequest)
+		return nil, 0, services.NewValidationError(services.CodeInvalidPage, "pageSize is required")
+	}
+	if err := services.ValidatePageOffset(pageNr, pageSize); err != nil {
+		return nil, 0, err
 	}
 
 	return sc.repository.GetAllSignings(deviceId, pageNr, pageSize)
 }
 
-func (sc *SignServiceImpl) Sign(deviceID string, data []byte) (string, string, error) {
-	if deviceID == "" {
-		return "", "", services.NewServiceError("device_id is a required field", http.StatusBadRequest)
+// GetSigningsPage returns the signings of the device next to the cursor in counter order, a nil cursor starts at the
+// first signing.
+func (sc *SignServiceImpl) GetSigningsPage(deviceId string, cursor *domain.PageCursor, pageSize int) (*domain.CursorPage[domain.Signings], error) {
+	if deviceId == "" {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "deviceId is required")
 	}
-
-	if len(data) == 0 {
-		return "", "", services.NewServiceError("data is a required field", http.StatusBadRequest)
+	if pageSize <= 0 {
+		return nil, services.NewValidationError(services.CodeInvalidPage, "pageSize is required")
 	}
-
-	device, err := sc.repository.FindByID(deviceID)
+	signings, more, err := sc.repository.GetSigningsPage(deviceId, cursor, pageSize)
 	if err != nil {
-		return "", "", err
-	}
-	if device == nil {
-		return "", "", services.NewServiceError("invalid device_id value", http.StatusBadRequest)
+		return nil, err
 	}
+	return services.NewCursorPage(signings, cursor, more, func(signing *domain.Signings) domain.PageCursor {
+		return domain.PageCursor{Counter: signing.Counter}
+	}), nil
+}
 
-	signature, signedData, err := sc.signTransaction(device, data)
-	if err != nil {
-		return "", "", err
+// GetSigning returns the signing of the device with the given counter, counters start at 1.
+func (sc *SignServiceImpl) GetSigning(deviceId string, counter int64) (*domain.Signings, error) {
+	if deviceId == "" {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "deviceId is required")
 	}
-	return signature, signedData, nil
+	if counter < 1 {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "counter must be at least 1")
+	}
+	return sc.repository.GetSigningByCounter(deviceId, counter)
 }
 
-func (sc *SignServiceImpl) signTransaction(device *domain.Device, data []byte) (string, string, error) {
-	signer, err := sc.loadKeyFromDevice(device)
-	if err != nil {
-		return "", "", err
+// GetSigningByID returns the signing with the given id, whichever device it belongs to.
+func (sc *SignServiceImpl) GetSigningByID(id string) (*domain.Signings, error) {
+	if id == "" {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "id is required")
 	}
+	return sc.repository.GetSigningByID(id)
+}
 
-	signature, err := signer.Sign(data)
-	if err != nil {
-		return "", "", err
+// Sign signs data with the active key of the device and stores the signing with the time it was created and the
+// client metadata.
+func (sc *SignServiceImpl) Sign(deviceID string, data []byte, metadata map[string]string) (*domain.Signings, error) {
+	if deviceID == "" {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "device_id is a required field")
 	}
 
-	currentSignatureEncoded := base64.StdEncoding.EncodeToString(signature)
+	if len(data) == 0 {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "data is a required field")
+	}
+	if err := services.ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
 
-	sc.counterMu.Lock()
-	counter, lastEncoded, err := sc.repository.GetDeviceCounterAndLastEncoded(device.ID)
+	device, err := sc.repository.FindByID(deviceID)
 	if err != nil {
-		sc.counterMu.Unlock()
-		return "", "", err
+		return nil, err
 	}
-	counter += 1
-	err = sc.repository.SaveDeviceCounterAndLastEncoded(device.ID, counter, currentSignatureEncoded, string(data))
-	if err != nil {
-		sc.counterMu.Unlock()
-		return "", "", err
+	if device == nil {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
 	}
-	sc.counterMu.Unlock()
-
-	if counter == 1 {
-		lastEncoded = base64.StdEncoding.EncodeToString([]byte(device.ID))
+	if device.State != domain.DeviceStateActive {
+		return nil, notActiveError(&domain.DeviceNotActiveError{State: device.State})
 	}
-	signedData := fmt.Sprintf("%d_%s_%s", counter, string(data), lastEncoded)
-
-	return currentSignatureEncoded, signedData, nil
-}
 
-func (sc *SignServiceImpl) loadKeyFromDevice(device *domain.Device) (crypto.Signer, error) {
-	marshaller, err := sc.cryptoFactory.CreateMarshaller(device.AlgorithmType)
-	if err != nil {
-		return nil, err
+	signing, err := sc.signTransaction(device, data, metadata)
+	var notActive *domain.DeviceNotActiveError
+	if errors.As(err, &notActive) {
+		// the device left the active state after it was read, the repository refused to sign
+		return nil, notActiveError(notActive)
 	}
-	key, err := marshaller.Decode(device.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
-	return key, nil
+	return signing, nil
+}
+
+func notActiveError(err *domain.DeviceNotActiveError) error {
+	return services.NewConflictError(services.CodeDeviceNotActive, err.Error())
+}
+
+// signTransaction reserves the next counter, builds the secured_data_to_be_signed string
+// (<counter>_<data>_<last_signature>) and signs exactly that string with the key the repository reports as active,
+// which may have been rotated since the device was read. The repository runs the whole sequence
+// atomically for the device, so the chain can't be forked by concurrent calls while other devices sign in parallel.
+func (sc *SignServiceImpl) signTransaction(device *domain.Device, data []byte, metadata map[string]string) (*domain.Signings, error) {
+	details := domain.SigningDetails{Clock: sc.clock, Metadata: metadata}
+	return sc.repository.AppendSigning(device.ID, details, func(counter int64, lastEncoded string, keyHandle string) (string, string, error) {
+		if counter == 1 {
+			lastEncoded = base64.StdEncoding.EncodeToString([]byte(device.ID))
+		}
+		securedData := fmt.Sprintf("%d_%s_%s", counter, string(data), lastEncoded)
+
+		signature, err := sc.keyStore.Sign(keyHandle, []byte(securedData))
+		if err != nil {
+			return "", "", err
+		}
+		return base64.StdEncoding.EncodeToString(signature), securedData, nil
+	})
 }
@@ -4,12 +4,15 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
-	"github.com/stretchr/testify/mock"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/keystore"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/sign/mocks"
 	"github.com/stretchr/testify/assert"
 )
@@ -56,6 +59,13 @@ func TestGetAllSignings(t *testing.T) {
 			inputPageSize: 0,
 			expectError:   true,
 		},
+		{
+			name:          "Page offset overflowing",
+			inputDeviceId: "device-1",
+			inputPageNr:   math.MaxInt/2 + 2,
+			inputPageSize: 2,
+			expectError:   true,
+		},
 		{
 			name:          "Repository Error",
 			inputDeviceId: "device-1",
@@ -69,7 +79,7 @@ func TestGetAllSignings(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			mockRepo := new(mocks.MockSignRepository)
-			service := NewSignService(mockRepo, nil)
+			service := NewSignService(mockRepo, nil, services.SystemClock)
 
 			if !test.expectError || test.mockDbError != nil {
 				mockRepo.On("GetAllSignings", test.inputDeviceId, test.inputPageNr, test.inputPageSize).
@@ -93,11 +103,99 @@ func TestGetAllSignings(t *testing.T) {
 	}
 }
 
+func TestGetSigning(t *testing.T) {
+	signing := &domain.Signings{ID: "signing-1", DeviceId: "device-1", Counter: 3}
+	notFound := services.NewNotFoundError(services.CodeSigningNotFound, "signing not found")
+	tests := []struct {
+		name          string
+		inputDeviceId string
+		inputCounter  int64
+		inputId       string
+		mockSigning   *domain.Signings
+		mockError     error
+		expectLookup  bool
+		expectedCode  string
+	}{
+		{
+			name:          "By counter",
+			inputDeviceId: "device-1",
+			inputCounter:  3,
+			mockSigning:   signing,
+			expectLookup:  true,
+		},
+		{
+			name:          "Unknown counter",
+			inputDeviceId: "device-1",
+			inputCounter:  4,
+			mockError:     notFound,
+			expectLookup:  true,
+			expectedCode:  services.CodeSigningNotFound,
+		},
+		{
+			name:          "Counter below 1",
+			inputDeviceId: "device-1",
+			inputCounter:  0,
+			expectedCode:  services.CodeInvalidRequest,
+		},
+		{
+			name:         "Empty DeviceID",
+			inputCounter: 1,
+			expectedCode: services.CodeInvalidRequest,
+		},
+		{
+			name:         "By id",
+			inputId:      "signing-1",
+			mockSigning:  signing,
+			expectLookup: true,
+		},
+		{
+			name:         "Unknown id",
+			inputId:      "signing-2",
+			mockError:    notFound,
+			expectLookup: true,
+			expectedCode: services.CodeSigningNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup
+			mockRepo := new(mocks.MockSignRepository)
+			service := NewSignService(mockRepo, nil, services.SystemClock)
+
+			// execute
+			var found *domain.Signings
+			var err error
+			if test.inputId != "" {
+				mockRepo.On("GetSigningByID", test.inputId).Return(test.mockSigning, test.mockError).Once()
+				found, err = service.GetSigningByID(test.inputId)
+			} else {
+				if test.expectLookup {
+					mockRepo.On("GetSigningByCounter", test.inputDeviceId, test.inputCounter).Return(test.mockSigning, test.mockError).Once()
+				}
+				found, err = service.GetSigning(test.inputDeviceId, test.inputCounter)
+			}
+
+			// asserts
+			if test.expectedCode != "" {
+				var serviceError *services.ServiceError
+				assert.ErrorAs(t, err, &serviceError)
+				assert.Equal(t, test.expectedCode, serviceError.Code)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.mockSigning, found)
+			}
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
 func TestSignTransactionValidity(t *testing.T) {
 	tests := []struct {
 		name             string
 		inputCounter     int64
 		tp               domain.AlgorithmType
+		options          domain.AlgorithmOptions
 		inputLastEncoded string
 		inputDeviceId    string
 		inputData        string
@@ -121,6 +219,24 @@ func TestSignTransactionValidity(t *testing.T) {
 			inputDeviceId:    "testing1",
 			inputData:        "testing---1",
 		},
+		{
+			name:             "Valid ECC P-256 with counter 3",
+			inputCounter:     3,
+			tp:               domain.AlgorithmTypeECC,
+			options:          domain.AlgorithmOptions{Curve: domain.CurveTypeP256},
+			inputLastEncoded: "test",
+			inputDeviceId:    "testing1",
+			inputData:        "testing---1",
+		},
+		{
+			name:             "Valid ECC P-521 with counter 3",
+			inputCounter:     3,
+			tp:               domain.AlgorithmTypeECC,
+			options:          domain.AlgorithmOptions{Curve: domain.CurveTypeP521},
+			inputLastEncoded: "test",
+			inputDeviceId:    "testing1",
+			inputData:        "testing---1",
+		},
 		{
 			name:             "Valid RSA with counter 0",
 			inputCounter:     0,
@@ -137,6 +253,31 @@ func TestSignTransactionValidity(t *testing.T) {
 			inputDeviceId:    "testing1",
 			inputData:        "testing---1",
 		},
+		{
+			name:             "Valid RSA PKCS1v15 with counter 2",
+			inputCounter:     2,
+			tp:               domain.AlgorithmTypeRSA,
+			options:          domain.AlgorithmOptions{Padding: domain.PaddingTypePKCS1v15},
+			inputLastEncoded: "test",
+			inputDeviceId:    "testing1",
+			inputData:        "testing---1",
+		},
+		{
+			name:             "Valid Ed25519 with counter 0",
+			inputCounter:     0,
+			tp:               domain.AlgorithmTypeEd25519,
+			inputLastEncoded: "",
+			inputDeviceId:    "testing1",
+			inputData:        "testing---1",
+		},
+		{
+			name:             "Valid Ed25519 with counter 7",
+			inputCounter:     7,
+			tp:               domain.AlgorithmTypeEd25519,
+			inputLastEncoded: "test",
+			inputDeviceId:    "testing1",
+			inputData:        "testing---1",
+		},
 		{
 			name:             "Valid Input with getError",
 			inputCounter:     0,
@@ -144,7 +285,7 @@ func TestSignTransactionValidity(t *testing.T) {
 			inputLastEncoded: "",
 			inputDeviceId:    "testing1",
 			inputData:        "testing---1",
-			getDeviceError:   services.NewDBError("get error"),
+			getDeviceError:   errors.New("get error"),
 			expectedError:    true,
 		},
 		{
@@ -154,7 +295,7 @@ func TestSignTransactionValidity(t *testing.T) {
 			inputLastEncoded: "",
 			inputDeviceId:    "testing1",
 			inputData:        "testing---1",
-			saveDeviceError:  services.NewDBError("get error"),
+			saveDeviceError:  errors.New("get error"),
 			expectedError:    true,
 		},
 	}
@@ -162,17 +303,14 @@ func TestSignTransactionValidity(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			// setup service and mocks
 			mockRepo := new(mocks.MockSignRepository)
-			factory := crypto.NewFactory()
-			mockDevice, _, expectedData := generateDeviceModel(t, test.inputDeviceId, test.inputCounter, test.tp, test.inputData, test.inputLastEncoded)
-			service := NewSignService(mockRepo, factory)
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			mockDevice, expectedData := generateDeviceModel(t, keyStore, test.inputDeviceId, test.inputCounter, test.tp, test.options, test.inputData, test.inputLastEncoded)
+			service := NewSignService(mockRepo, keyStore, services.SystemClock)
 
-			mockRepo.On("GetDeviceCounterAndLastEncoded", test.inputDeviceId).Return(test.inputCounter, test.inputLastEncoded, test.getDeviceError).Once()
-			if test.getDeviceError == nil {
-				mockRepo.On("SaveDeviceCounterAndLastEncoded", test.inputDeviceId, test.inputCounter+1, mock.Anything, mock.Anything).Return(test.saveDeviceError).Once()
-			}
+			mockRepo.On("AppendSigning", test.inputDeviceId).Return(test.inputCounter, test.inputLastEncoded, mockDevice.KeyHandle, test.getDeviceError, test.saveDeviceError).Once()
 
 			// execute
-			_, signedData, err := service.signTransaction(mockDevice, []byte(test.inputData))
+			signing, err := service.signTransaction(mockDevice, []byte(test.inputData), nil)
 
 			// asserts
 			if test.expectedError {
@@ -180,9 +318,15 @@ func TestSignTransactionValidity(t *testing.T) {
 			} else {
 				assert.NoError(t, err)
 
-				// this can be equal since when signing we are using random reader
-				//assert.Equal(t, expectedSignature, signature)
-				assert.Equal(t, expectedData, signedData)
+				assert.Equal(t, expectedData, signing.SignedData)
+
+				// the signature has to cover the secured data, not only the raw input
+				decoded, err := base64.StdEncoding.DecodeString(signing.Signature)
+				assert.NoError(t, err)
+				verifier, err := keyStore.PublicKey(mockDevice.KeyHandle)
+				assert.NoError(t, err)
+				assert.NoError(t, verifier.VerifySignature([]byte(expectedData), decoded))
+				assert.Error(t, verifier.VerifySignature([]byte(test.inputData), decoded))
 			}
 			mockRepo.AssertExpectations(t)
 		})
@@ -190,27 +334,170 @@ func TestSignTransactionValidity(t *testing.T) {
 
 }
 
-func generateDeviceModel(t *testing.T, id string, counter int64, tp domain.AlgorithmType, data, lastSignature string) (*domain.Device, string, string) {
-	factory := crypto.NewFactory()
-	algorithm, err := factory.GenerateAlgorithm(tp)
-	if err != nil {
-		t.Error(err)
+func TestSignTransactionKeyStoreError(t *testing.T) {
+	// setup service and mocks
+	mockRepo := new(mocks.MockSignRepository)
+	mockKeyStore := new(mocks.MockKeyStore)
+	service := NewSignService(mockRepo, mockKeyStore, services.SystemClock)
+	device := &domain.Device{ID: "testing1", KeyHandle: "handle-1"}
+
+	mockRepo.On("AppendSigning", device.ID).Return(int64(3), "test", device.KeyHandle, nil, nil).Once()
+	mockKeyStore.On("Sign", device.KeyHandle, []byte("4_testing---1_test")).Return(nil, errors.New("key store unavailable")).Once()
+
+	// execute
+	_, err := service.signTransaction(device, []byte("testing---1"), nil)
+
+	// asserts: nothing is persisted when the key store can't sign
+	assert.Error(t, err)
+	mockRepo.AssertExpectations(t)
+	mockKeyStore.AssertExpectations(t)
+}
+
+func TestSignTransactionUsesActiveKey(t *testing.T) {
+	// setup service and mocks: the key was rotated after the device was read
+	mockRepo := new(mocks.MockSignRepository)
+	mockKeyStore := new(mocks.MockKeyStore)
+	service := NewSignService(mockRepo, mockKeyStore, services.SystemClock)
+	device := &domain.Device{ID: "testing1", KeyHandle: "handle-1"}
+
+	mockRepo.On("AppendSigning", device.ID).Return(int64(3), "test", "handle-2", nil, nil).Once()
+	mockKeyStore.On("Sign", "handle-2", []byte("4_testing---1_test")).Return([]byte("signature"), nil).Once()
+
+	// execute
+	_, err := service.signTransaction(device, []byte("testing---1"), nil)
+
+	// asserts: the repository decides which key signs
+	assert.NoError(t, err)
+	mockRepo.AssertExpectations(t)
+	mockKeyStore.AssertExpectations(t)
+}
+
+func TestSignDeviceState(t *testing.T) {
+	tests := []struct {
+		name          string
+		state         domain.DeviceState
+		appendError   error
+		expectAppend  bool
+		expectedError bool
+	}{
+		{
+			name:         "Active device signs",
+			state:        domain.DeviceStateActive,
+			expectAppend: true,
+		},
+		{
+			name:          "Suspended device is rejected",
+			state:         domain.DeviceStateSuspended,
+			expectedError: true,
+		},
+		{
+			name:          "Decommissioned device is rejected",
+			state:         domain.DeviceStateDecommissioned,
+			expectedError: true,
+		},
+		{
+			name:          "Device suspended while signing",
+			state:         domain.DeviceStateActive,
+			appendError:   &domain.DeviceNotActiveError{State: domain.DeviceStateSuspended},
+			expectAppend:  true,
+			expectedError: true,
+		},
 	}
-	marshaller, err := factory.CreateMarshaller(tp)
-	if err != nil {
-		t.Error(err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup service and mocks
+			mockRepo := new(mocks.MockSignRepository)
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			device, _ := generateDeviceModel(t, keyStore, "testing1", 0, domain.AlgorithmTypeEd25519, domain.AlgorithmOptions{}, "data", "")
+			device.State = test.state
+			service := NewSignService(mockRepo, keyStore, services.SystemClock)
+
+			mockRepo.On("FindByID", device.ID).Return(device, nil).Once()
+			if test.expectAppend {
+				mockRepo.On("AppendSigning", device.ID).Return(int64(0), "", device.KeyHandle, test.appendError, nil).Once()
+			}
+
+			// execute
+			_, err := service.Sign(device.ID, []byte("data"), nil)
+
+			// asserts
+			if test.expectedError {
+				assert.Error(t, err)
+				var serviceError *services.ServiceError
+				assert.ErrorAs(t, err, &serviceError)
+				assert.Equal(t, services.CodeDeviceNotActive, serviceError.Code)
+			} else {
+				assert.NoError(t, err)
+			}
+			mockRepo.AssertExpectations(t)
+		})
 	}
-	publicBytes, privateBytes, err := marshaller.Encode(algorithm)
-	if err != nil {
-		t.Error(err)
+}
+
+func TestSignDetails(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		metadata      map[string]string
+		expectAppend  bool
+		expectedError string
+	}{
+		{
+			name:         "Without metadata",
+			expectAppend: true,
+		},
+		{
+			name:         "With metadata",
+			metadata:     map[string]string{"receipt": "R-1", "till": "2"},
+			expectAppend: true,
+		},
+		{
+			name:          "Empty metadata key",
+			metadata:      map[string]string{"": "R-1"},
+			expectedError: services.CodeInvalidMetadata,
+		},
+		{
+			name:          "Metadata value too long",
+			metadata:      map[string]string{"receipt": strings.Repeat("r", services.MaxMetadataValueLength+1)},
+			expectedError: services.CodeInvalidMetadata,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup service and mocks
+			mockRepo := new(mocks.MockSignRepository)
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			device, _ := generateDeviceModel(t, keyStore, "testing1", 0, domain.AlgorithmTypeEd25519, domain.AlgorithmOptions{}, "data", "")
+			device.State = domain.DeviceStateActive
+			service := NewSignService(mockRepo, keyStore, func() time.Time { return createdAt })
+
+			if test.expectAppend {
+				mockRepo.On("FindByID", device.ID).Return(device, nil).Once()
+				mockRepo.On("AppendSigning", device.ID).Return(int64(0), "", device.KeyHandle, nil, nil).Once()
+			}
+
+			// execute
+			signing, err := service.Sign(device.ID, []byte("data"), test.metadata)
+
+			// asserts
+			if test.expectedError != "" {
+				var serviceError *services.ServiceError
+				assert.ErrorAs(t, err, &serviceError)
+				assert.Equal(t, test.expectedError, serviceError.Code)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, createdAt, signing.CreatedAt)
+				assert.Equal(t, test.metadata, signing.Metadata)
+			}
+			mockRepo.AssertExpectations(t)
+		})
 	}
+}
 
-	// signature
-	signature, err := algorithm.Sign([]byte(data))
+func generateDeviceModel(t *testing.T, keyStore *keystore.SoftwareKeyStore, id string, counter int64, tp domain.AlgorithmType, options domain.AlgorithmOptions, data, lastSignature string) (*domain.Device, string) {
+	keyHandle, err := keyStore.Generate(tp, options)
 	if err != nil {
 		t.Error(err)
 	}
-	currentSignatureEncoded := base64.StdEncoding.EncodeToString(signature)
 
 	if counter == 0 {
 		lastSignature = base64.StdEncoding.EncodeToString([]byte(id))
@@ -220,8 +507,9 @@ func generateDeviceModel(t *testing.T, id string, counter int64, tp domain.Algor
 	return &domain.Device{
 		ID:            id,
 		AlgorithmType: tp,
+		Options:       options,
 		Counter:       counter,
-		PublicKey:     publicBytes,
-		PrivateKey:    privateBytes,
-	}, currentSignatureEncoded, signedData
+		KeyID:         "key-1",
+		KeyHandle:     keyHandle,
+	}, signedData
 }
@@ -0,0 +1,231 @@
+package sign
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+)
+
+type VerifyService interface {
+	Verify(deviceID string, signedData string, signature string) (bool, string, error)
+	VerifyChain(deviceID string) (*ChainVerificationResult, error)
+}
+
+type VerifyRepository interface {
+	FindByID(id string) (*domain.Device, error)
+	GetSigningChain(deviceId string) ([]*domain.Signings, error)
+	GetDeviceSigners(deviceId string) ([]*domain.DeviceSigner, error)
+}
+
+// ChainVerificationResult describes the outcome of walking the whole signature chain of a device.
+// When the chain is broken, BrokenCounter points to the first entry that failed and Reason explains why.
+type ChainVerificationResult struct {
+	Valid         bool
+	VerifiedCount int
+	BrokenCounter int64
+	Reason        string
+}
+
+type VerifyServiceImpl struct {
+	repository VerifyRepository
+	keyStore   KeyStore
+}
+
+func NewVerifyService(repository VerifyRepository, keyStore KeyStore) *VerifyServiceImpl {
+	return &VerifyServiceImpl{
+		repository: repository,
+		keyStore:   keyStore,
+	}
+}
+
+// Verify checks the base64 encoded signature against signedData using the public keys of the device, newest first,
+// so signatures made before a key rotation stay valid.
+// An invalid signature is not an error: it is reported through the returned flag and reason.
+func (vs *VerifyServiceImpl) Verify(deviceID string, signedData string, signature string) (bool, string, error) {
+	if deviceID == "" {
+		return false, "", services.NewValidationError(services.CodeInvalidRequest, "device_id is a required field")
+	}
+	if signedData == "" {
+		return false, "", services.NewValidationError(services.CodeInvalidRequest, "signed_data is a required field")
+	}
+	if signature == "" {
+		return false, "", services.NewValidationError(services.CodeInvalidRequest, "signature is a required field")
+	}
+
+	device, err := vs.repository.FindByID(deviceID)
+	if err != nil {
+		return false, "", err
+	}
+	if device == nil {
+		return false, "", services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+
+	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false, "signature is not valid base64", nil
+	}
+
+	signers, err := vs.repository.GetDeviceSigners(deviceID)
+	if err != nil {
+		return false, "", err
+	}
+
+	var reason string
+	for i := len(signers) - 1; i >= 0; i-- {
+		verifier, err := vs.keyStore.PublicKey(signers[i].KeyHandle)
+		if err != nil {
+			return false, "", err
+		}
+		err = verifier.VerifySignature([]byte(signedData), decodedSignature)
+		if err == nil {
+			return true, "", nil
+		}
+		if reason == "" {
+			reason = err.Error()
+		}
+	}
+	if len(signers) > 1 {
+		reason = fmt.Sprintf("signature matches none of the %d keys of the device", len(signers))
+	}
+	return false, reason, nil
+}
+
+// VerifyChain walks every signing of the device in counter order and checks that the counter has no gaps,
+// that each entry references the signature of its predecessor (base64 of the device id for the first one)
+// and that every signature is valid for the public key of the key it records. Keys only ever move forward: an entry
+// signed with an older key than the one before it breaks the chain. It stops at the first broken link.
+func (vs *VerifyServiceImpl) VerifyChain(deviceID string) (*ChainVerificationResult, error) {
+	if deviceID == "" {
+		return nil, services.NewValidationError(services.CodeInvalidRequest, "device_id is a required field")
+	}
+
+	device, err := vs.repository.FindByID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, services.NewNotFoundError(services.CodeDeviceNotFound, "device not found")
+	}
+
+	// read after the device: signings appended in between only make the chain longer than the counter
+	chain, err := vs.repository.GetSigningChain(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	signers, err := vs.repository.GetDeviceSigners(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	keys := newChainKeys(vs.keyStore, signers)
+
+	lastSignature := base64.StdEncoding.EncodeToString([]byte(device.ID))
+	for i, signing := range chain {
+		expectedCounter := int64(i + 1)
+		verifier, reason, err := keys.verifier(signing, expectedCounter)
+		if err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			reason = checkChainLink(verifier, signing, expectedCounter, lastSignature)
+		}
+		if reason != "" {
+			return &ChainVerificationResult{
+				VerifiedCount: i,
+				BrokenCounter: expectedCounter,
+				Reason:        reason,
+			}, nil
+		}
+		lastSignature = signing.Signature
+	}
+
+	if device.Counter > int64(len(chain)) {
+		return &ChainVerificationResult{
+			VerifiedCount: len(chain),
+			BrokenCounter: int64(len(chain) + 1),
+			Reason:        fmt.Sprintf("device counter %d is ahead of the %d stored signings", device.Counter, len(chain)),
+		}, nil
+	}
+
+	return &ChainVerificationResult{
+		Valid:         true,
+		VerifiedCount: len(chain),
+	}, nil
+}
+
+// chainKeys follows the keys of a device along its chain, loading each public key once.
+type chainKeys struct {
+	keyStore    KeyStore
+	signers     map[string]*domain.DeviceSigner
+	verifiers   map[string]crypto.Verifier
+	lastVersion int
+}
+
+func newChainKeys(keyStore KeyStore, signers []*domain.DeviceSigner) *chainKeys {
+	keys := &chainKeys{
+		keyStore:  keyStore,
+		signers:   make(map[string]*domain.DeviceSigner, len(signers)),
+		verifiers: map[string]crypto.Verifier{},
+	}
+	for _, signer := range signers {
+		keys.signers[signer.ID] = signer
+	}
+	return keys
+}
+
+// verifier returns the public key the signing records, or the reason why that key can't have signed it.
+// A nil signing gets neither, checkChainLink reports it.
+func (k *chainKeys) verifier(signing *domain.Signings, expectedCounter int64) (crypto.Verifier, string, error) {
+	if signing == nil {
+		return nil, "", nil
+	}
+	signer, known := k.signers[signing.KeyID]
+	if !known {
+		return nil, fmt.Sprintf("counter %d was signed with unknown key %q", expectedCounter, signing.KeyID), nil
+	}
+	if signer.Version < k.lastVersion {
+		return nil, fmt.Sprintf("counter %d was signed with key version %d after version %d", expectedCounter, signer.Version, k.lastVersion), nil
+	}
+	k.lastVersion = signer.Version
+
+	if verifier, loaded := k.verifiers[signer.ID]; loaded {
+		return verifier, "", nil
+	}
+	verifier, err := k.keyStore.PublicKey(signer.KeyHandle)
+	if err != nil {
+		return nil, "", err
+	}
+	k.verifiers[signer.ID] = verifier
+	return verifier, "", nil
+}
+
+// checkChainLink returns the reason why the signing is not a valid successor of lastSignature, or an empty string.
+func checkChainLink(verifier crypto.Verifier, signing *domain.Signings, expectedCounter int64, lastSignature string) string {
+	if signing == nil {
+		return fmt.Sprintf("missing signing for counter %d", expectedCounter)
+	}
+	if signing.Counter != expectedCounter {
+		return fmt.Sprintf("counter gap: expected %d, got %d", expectedCounter, signing.Counter)
+	}
+
+	prefix := fmt.Sprintf("%d_", expectedCounter)
+	suffix := "_" + lastSignature
+	if len(signing.SignedData) < len(prefix)+len(suffix) ||
+		!strings.HasPrefix(signing.SignedData, prefix) ||
+		!strings.HasSuffix(signing.SignedData, suffix) {
+		return fmt.Sprintf("signed data of counter %d does not reference the previous signature", expectedCounter)
+	}
+
+	decodedSignature, err := base64.StdEncoding.DecodeString(signing.Signature)
+	if err != nil {
+		return fmt.Sprintf("signature of counter %d is not valid base64", expectedCounter)
+	}
+	if err = verifier.VerifySignature([]byte(signing.SignedData), decodedSignature); err != nil {
+		return fmt.Sprintf("signature of counter %d is invalid: %v", expectedCounter, err)
+	}
+	return ""
+}
@@ -0,0 +1,373 @@
+package sign
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/keystore"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/internal/services/sign/mocks"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name            string
+		tp              domain.AlgorithmType
+		inputDeviceId   string
+		inputSignedData string
+		tamperedData    string
+		badSignature    bool
+		rotatedKey      bool
+		findDeviceError error
+		expectedValid   bool
+		expectedError   bool
+	}{
+		{
+			name:            "Valid ECC signature",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			expectedValid:   true,
+		},
+		{
+			name:            "Valid RSA signature",
+			tp:              domain.AlgorithmTypeRSA,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			expectedValid:   true,
+		},
+		{
+			name:            "Valid Ed25519 signature",
+			tp:              domain.AlgorithmTypeEd25519,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			expectedValid:   true,
+		},
+		{
+			name:            "Tampered ECC data",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			tamperedData:    "2_testing---1_dGVzdGluZzE=",
+		},
+		{
+			name:            "Tampered RSA data",
+			tp:              domain.AlgorithmTypeRSA,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			tamperedData:    "2_testing---1_dGVzdGluZzE=",
+		},
+		{
+			name:            "Signature of a rotated key",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			rotatedKey:      true,
+			expectedValid:   true,
+		},
+		{
+			name:            "Tampered data with a rotated key",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			tamperedData:    "2_testing---1_dGVzdGluZzE=",
+			rotatedKey:      true,
+		},
+		{
+			name:            "Signature not base64",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			badSignature:    true,
+		},
+		{
+			name:            "Unknown device",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "1_testing---1_dGVzdGluZzE=",
+			findDeviceError: services.NewNotFoundError(services.CodeDeviceNotFound, "device not found"),
+			expectedError:   true,
+		},
+		{
+			name:            "Empty signed data",
+			tp:              domain.AlgorithmTypeECC,
+			inputDeviceId:   "testing1",
+			inputSignedData: "",
+			expectedError:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup service and mocks
+			mockRepo := new(mocks.MockSignRepository)
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			service := NewVerifyService(mockRepo, keyStore)
+			mockDevice, _ := generateDeviceModel(t, keyStore, test.inputDeviceId, 0, test.tp, domain.AlgorithmOptions{}, "", "")
+			signers := []*domain.DeviceSigner{deviceSigner(mockDevice, 1)}
+			if test.rotatedKey {
+				// the signature was made with the first key, the device signs with a newer one now
+				signers = append(signers, generateSigner(t, keyStore, mockDevice, 2))
+			}
+
+			signature, err := keyStore.Sign(signers[0].KeyHandle, []byte(test.inputSignedData))
+			assert.NoError(t, err)
+			encodedSignature := base64.StdEncoding.EncodeToString(signature)
+			if test.badSignature {
+				encodedSignature = "not base64!"
+			}
+			dataToVerify := test.inputSignedData
+			if test.tamperedData != "" {
+				dataToVerify = test.tamperedData
+			}
+
+			if test.inputSignedData != "" {
+				if test.findDeviceError != nil {
+					mockRepo.On("FindByID", test.inputDeviceId).Return(nil, test.findDeviceError).Once()
+				} else {
+					mockRepo.On("FindByID", test.inputDeviceId).Return(mockDevice, nil).Once()
+					if !test.badSignature {
+						mockRepo.On("GetDeviceSigners", test.inputDeviceId).Return(signers, nil).Once()
+					}
+				}
+			}
+
+			// execute
+			valid, reason, err := service.Verify(test.inputDeviceId, dataToVerify, encodedSignature)
+
+			// asserts
+			if test.expectedError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expectedValid, valid)
+				if test.expectedValid {
+					assert.Empty(t, reason)
+				} else {
+					assert.NotEmpty(t, reason)
+				}
+			}
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name                  string
+		tp                    domain.AlgorithmType
+		options               domain.AlgorithmOptions
+		chainLength           int
+		keys                  int
+		deviceCounter         int64
+		tamper                func(chain []*domain.Signings)
+		expectedValid         bool
+		expectedBrokenCounter int64
+	}{
+		{
+			name:          "Empty chain",
+			tp:            domain.AlgorithmTypeECC,
+			expectedValid: true,
+		},
+		{
+			name:          "Valid ECC chain",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   5,
+			deviceCounter: 5,
+			expectedValid: true,
+		},
+		{
+			name:          "Valid RSA chain",
+			tp:            domain.AlgorithmTypeRSA,
+			chainLength:   5,
+			deviceCounter: 5,
+			expectedValid: true,
+		},
+		{
+			name:          "Valid RSA PKCS1v15 chain",
+			tp:            domain.AlgorithmTypeRSA,
+			options:       domain.AlgorithmOptions{Padding: domain.PaddingTypePKCS1v15},
+			chainLength:   3,
+			deviceCounter: 3,
+			expectedValid: true,
+		},
+		{
+			name:          "Valid Ed25519 chain",
+			tp:            domain.AlgorithmTypeEd25519,
+			chainLength:   5,
+			deviceCounter: 5,
+			expectedValid: true,
+		},
+		{
+			name:          "Valid chain across key rotations",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   6,
+			keys:          3,
+			deviceCounter: 6,
+			expectedValid: true,
+		},
+		{
+			name:          "Signed with an unknown key",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   4,
+			keys:          2,
+			deviceCounter: 4,
+			tamper: func(chain []*domain.Signings) {
+				chain[2].KeyID = "unknown"
+			},
+			expectedBrokenCounter: 3,
+		},
+		{
+			name:          "Signed with an older key after a rotation",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   4,
+			keys:          2,
+			deviceCounter: 4,
+			tamper: func(chain []*domain.Signings) {
+				chain[3].KeyID = chain[0].KeyID
+			},
+			expectedBrokenCounter: 4,
+		},
+		{
+			name:          "Signature made with another key than recorded",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   4,
+			keys:          2,
+			deviceCounter: 4,
+			tamper: func(chain []*domain.Signings) {
+				chain[1].KeyID = chain[2].KeyID
+			},
+			expectedBrokenCounter: 2,
+		},
+		{
+			name:          "Counter gap",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   5,
+			deviceCounter: 5,
+			tamper: func(chain []*domain.Signings) {
+				chain[2].Counter = 4
+			},
+			expectedBrokenCounter: 3,
+		},
+		{
+			name:          "Broken link to previous signature",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   5,
+			deviceCounter: 5,
+			tamper: func(chain []*domain.Signings) {
+				chain[3].Signature = chain[1].Signature
+			},
+			expectedBrokenCounter: 4,
+		},
+		{
+			name:          "Tampered signed data",
+			tp:            domain.AlgorithmTypeRSA,
+			chainLength:   3,
+			deviceCounter: 3,
+			tamper: func(chain []*domain.Signings) {
+				chain[0].SignedData = fmt.Sprintf("1_%s_%s", "changed", base64.StdEncoding.EncodeToString([]byte("testing1")))
+			},
+			expectedBrokenCounter: 1,
+		},
+		{
+			name:          "Signed since the device was read",
+			tp:            domain.AlgorithmTypeECC,
+			chainLength:   5,
+			deviceCounter: 3,
+			expectedValid: true,
+		},
+		{
+			name:                  "Device counter ahead of chain",
+			tp:                    domain.AlgorithmTypeECC,
+			chainLength:           2,
+			deviceCounter:         3,
+			expectedBrokenCounter: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// setup service and mocks
+			mockRepo := new(mocks.MockSignRepository)
+			keyStore := keystore.NewSoftwareKeyStore(crypto.NewFactory())
+			service := NewVerifyService(mockRepo, keyStore)
+			mockDevice, _ := generateDeviceModel(t, keyStore, "testing1", test.deviceCounter, test.tp, test.options, "", "")
+			signers := []*domain.DeviceSigner{deviceSigner(mockDevice, 1)}
+			for version := 2; version <= test.keys; version++ {
+				signers = append(signers, generateSigner(t, keyStore, mockDevice, version))
+			}
+			chain := generateChain(t, keyStore, mockDevice.ID, test.chainLength, signers...)
+			if test.tamper != nil {
+				test.tamper(chain)
+			}
+
+			mockRepo.On("FindByID", mockDevice.ID).Return(mockDevice, nil).Once()
+			mockRepo.On("GetSigningChain", mockDevice.ID).Return(chain, nil).Once()
+			mockRepo.On("GetDeviceSigners", mockDevice.ID).Return(signers, nil).Once()
+
+			// execute
+			result, err := service.VerifyChain(mockDevice.ID)
+
+			// asserts
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedValid, result.Valid)
+			assert.Equal(t, test.expectedBrokenCounter, result.BrokenCounter)
+			if test.expectedValid {
+				assert.Equal(t, test.chainLength, result.VerifiedCount)
+				assert.Empty(t, result.Reason)
+			} else {
+				assert.NotEmpty(t, result.Reason)
+			}
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+// generateChain signs length entries, spread in order over the given keys.
+func generateChain(t *testing.T, keyStore *keystore.SoftwareKeyStore, deviceId string, length int, signers ...*domain.DeviceSigner) []*domain.Signings {
+	var chain []*domain.Signings
+	lastSignature := base64.StdEncoding.EncodeToString([]byte(deviceId))
+	for i := 1; i <= length; i++ {
+		signer := signers[(i-1)*len(signers)/length]
+		signedData := fmt.Sprintf("%d_data-%d_%s", i, i, lastSignature)
+		signature, err := keyStore.Sign(signer.KeyHandle, []byte(signedData))
+		if err != nil {
+			t.Error(err)
+		}
+		lastSignature = base64.StdEncoding.EncodeToString(signature)
+		chain = append(chain, &domain.Signings{
+			DeviceId:   deviceId,
+			Counter:    int64(i),
+			Signature:  lastSignature,
+			SignedData: signedData,
+			KeyID:      signer.ID,
+		})
+	}
+	return chain
+}
+
+// deviceSigner describes the active key of the device.
+func deviceSigner(device *domain.Device, version int) *domain.DeviceSigner {
+	return &domain.DeviceSigner{
+		ID:            device.KeyID,
+		DeviceId:      device.ID,
+		Version:       version,
+		AlgorithmType: device.AlgorithmType,
+		Options:       device.Options,
+		KeyHandle:     device.KeyHandle,
+	}
+}
+
+// generateSigner rotates the key of the device to a new one with the given version.
+func generateSigner(t *testing.T, keyStore *keystore.SoftwareKeyStore, device *domain.Device, version int) *domain.DeviceSigner {
+	keyHandle, err := keyStore.Generate(device.AlgorithmType, device.Options)
+	if err != nil {
+		t.Error(err)
+	}
+	device.KeyID = fmt.Sprintf("key-%d", version)
+	device.KeyHandle = keyHandle
+	return deviceSigner(device, version)
+}